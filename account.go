@@ -0,0 +1,699 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultPasswordResetTTL           = time.Hour
+	defaultEmailVerificationTTL       = 24 * time.Hour
+	defaultVerificationResendWait     = 5 * time.Minute
+	defaultPasswordResetResendWait    = 5 * time.Minute
+	defaultUnverifiedMaxSubscriptions = 5
+	// Time allowed for a password reset requested in the background
+	passwordResetRequestTimeout = time.Minute
+	// Time allowed for the email sent in the background after registering
+	registrationMailTimeout = time.Minute
+	// How recently an account without a password must have signed in through
+	// its identity provider to set a password or change its email
+	reauthWindow = 10 * time.Minute
+)
+
+var (
+	ErrVerificationRequired = errors.New("Email verification required")
+	ErrAlreadyVerified      = errors.New("Email is already verified")
+	ErrWrongPassword        = errors.New("Current password is incorrect")
+	ErrReauthRequired       = errors.New("Sign in again through your identity provider to make this change")
+)
+
+type ForgotPasswordInput struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordInput struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type VerifyEmailInput struct {
+	Token string `json:"token"`
+}
+
+type ChangePasswordInput struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type ChangeEmailInput struct {
+	Email           string `json:"email"`
+	CurrentPassword string `json:"current_password"`
+}
+
+type ChangeUsernameInput struct {
+	Username string `json:"username"`
+}
+
+// Reads how long reset tokens last from PASSWORD_RESET_TTL, falling back to the default
+func getPasswordResetTTL() time.Duration {
+	return getDurationEnv("PASSWORD_RESET_TTL", defaultPasswordResetTTL)
+}
+
+// Reads how long verification tokens last from EMAIL_VERIFICATION_TTL, falling back to the default
+func getEmailVerificationTTL() time.Duration {
+	return getDurationEnv("EMAIL_VERIFICATION_TTL", defaultEmailVerificationTTL)
+}
+
+// Reads the minimum time between verification emails from EMAIL_VERIFICATION_RESEND_WAIT
+func getVerificationResendWait() time.Duration {
+	return getDurationEnv("EMAIL_VERIFICATION_RESEND_WAIT", defaultVerificationResendWait)
+}
+
+// Reads the minimum time between password reset emails from PASSWORD_RESET_RESEND_WAIT
+func getPasswordResetResendWait() time.Duration {
+	return getDurationEnv("PASSWORD_RESET_RESEND_WAIT", defaultPasswordResetResendWait)
+}
+
+// Reads how many subscriptions an unverified user may have from
+// UNVERIFIED_MAX_SUBSCRIPTIONS. A negative value removes the limit.
+func getUnverifiedMaxSubscriptions() int {
+	value := os.Getenv("UNVERIFIED_MAX_SUBSCRIPTIONS")
+	if value == "" {
+		return defaultUnverifiedMaxSubscriptions
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid UNVERIFIED_MAX_SUBSCRIPTIONS %q, using %d", value, defaultUnverifiedMaxSubscriptions)
+		return defaultUnverifiedMaxSubscriptions
+	}
+
+	return n
+}
+
+// Builds a link to a frontend page from APP_BASE_URL
+func appURL(path string, params url.Values) string {
+	base := strings.TrimSuffix(os.Getenv("APP_BASE_URL"), "/")
+	return base + path + "?" + params.Encode()
+}
+
+// Creates a reset token for the user, invalidating any earlier ones, and emails a reset link
+func (h *Handler) sendPasswordReset(ctx context.Context, user User) error {
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	if _, err := h.conn.Exec(
+		ctx,
+		"UPDATE password_resets SET used_at = now() WHERE user_id = $1 AND used_at IS NULL",
+		user.Id,
+	); err != nil {
+		return fmt.Errorf("error invalidating reset tokens: %w", err)
+	}
+
+	ttl := getPasswordResetTTL()
+	if _, err := h.conn.Exec(
+		ctx,
+		"INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		user.Id, tokenHash, time.Now().Add(ttl),
+	); err != nil {
+		return fmt.Errorf("error storing reset token: %w", err)
+	}
+
+	link := appURL("/reset-password", url.Values{"token": {token}})
+	return h.mailer.Send(ctx, Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse the link below to reset your password. It expires in %v.\n\n%s\n\nIf you didn't ask to reset your password you can ignore this email.\n",
+			user.Username, ttl, link,
+		),
+	})
+}
+
+// Tells the owner of an account that someone tried to register with its email
+func (h *Handler) sendRegistrationNotice(ctx context.Context, user User) error {
+	link := appURL("/forgot-password", url.Values{"email": {user.Email}})
+	return h.mailer.Send(ctx, Mail{
+		To:      user.Email,
+		Subject: "You already have an account",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone tried to create an account with this email address, which already has one. If it was you, sign in instead, or reset your password if you've forgotten it:\n\n%s\n\nIf it wasn't you, you can ignore this email.\n",
+			user.Username, link,
+		),
+	})
+}
+
+func (h *Handler) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	// Parse the JSON request body
+	var input ForgotPasswordInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if input.Email == "" {
+		http.Error(w, "Missing required field (email)", http.StatusBadRequest)
+		return
+	}
+
+	// The reset is sent in the background so the status and timing of the
+	// response are the same whether or not the email has an account
+	go func(email string) {
+		ctx, cancel := context.WithTimeout(context.Background(), passwordResetRequestTimeout)
+		defer cancel()
+
+		if err := h.requestPasswordReset(ctx, email); err != nil {
+			log.Printf("Error sending password reset: %v", err)
+		}
+	}(input.Email)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Sends a password reset to the account with this email, if there is one. Nothing
+// is sent while a recent reset is still unused, so repeated requests can't flood
+// the inbox or keep invalidating the link the owner was sent.
+func (h *Handler) requestPasswordReset(ctx context.Context, email string) error {
+	var user User
+	var lastSent *time.Time
+	query := `
+    SELECT u.id, u.username, u.email,
+        (SELECT max(r.created_at) FROM password_resets r WHERE r.user_id = u.id AND r.used_at IS NULL)
+    FROM users u
+    WHERE u.email = $1
+    `
+	err := h.conn.QueryRow(ctx, query, email).Scan(&user.Id, &user.Username, &user.Email, &lastSent)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting user: %w", err)
+	}
+
+	if lastSent != nil && time.Since(*lastSent) < getPasswordResetResendWait() {
+		return nil
+	}
+
+	return h.sendPasswordReset(ctx, user)
+}
+
+func (h *Handler) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	// Parse the JSON request body
+	var input ResetPasswordInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if input.Token == "" || input.Password == "" {
+		http.Error(w, "Missing required fields (token, password)", http.StatusBadRequest)
+		return
+	}
+
+	// Create password hash
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	// The token is only used up if the password is changed and the old
+	// credentials are revoked with it
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	reset := *h
+	reset.conn = tx
+
+	// Use up the token, only if it is still valid
+	var userID string
+	err = tx.QueryRow(
+		ctx,
+		"UPDATE password_resets SET used_at = now() WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now() RETURNING user_id",
+		hashToken(input.Token),
+	).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking reset token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		"UPDATE users SET password = $2, has_password = true WHERE id = $1",
+		userID, hashedPassword,
+	); err != nil {
+		http.Error(w, fmt.Sprintf("Error updating password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Sign out everywhere and revoke API keys, since the old password may have
+	// been compromised
+	if err := reset.revokeUserSessions(ctx, userID); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := reset.revokeUserAPIKeys(ctx, userID); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking API keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error updating password: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Creates a verification token for the user's current email and emails a verification link
+func (h *Handler) sendEmailVerification(ctx context.Context, user User) error {
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := getEmailVerificationTTL()
+	if _, err := h.conn.Exec(
+		ctx,
+		"INSERT INTO email_verifications (user_id, email, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		user.Id, user.Email, tokenHash, time.Now().Add(ttl),
+	); err != nil {
+		return fmt.Errorf("error storing verification token: %w", err)
+	}
+
+	link := appURL("/verify-email", url.Values{"token": {token}})
+	return h.mailer.Send(ctx, Mail{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse the link below to verify your email address. It expires in %v.\n\n%s\n",
+			user.Username, ttl, link,
+		),
+	})
+}
+
+// Checks that the user may add more subscriptions. Unverified users are limited
+// to getUnverifiedMaxSubscriptions.
+func (h *Handler) checkSubscriptionLimit(ctx context.Context, userID string, adding int) error {
+	limit := getUnverifiedMaxSubscriptions()
+	if limit < 0 {
+		return nil
+	}
+
+	var verified bool
+	var count int
+	query := `
+    SELECT u.email_verified_at IS NOT NULL, (SELECT COUNT(*) FROM subscriptions s WHERE s.user_id = u.id)
+    FROM users u
+    WHERE u.id = $1
+    `
+	if err := h.conn.QueryRow(ctx, query, userID).Scan(&verified, &count); err != nil {
+		return fmt.Errorf("error checking subscription limit: %w", err)
+	}
+
+	if !verified && count+adding > limit {
+		return fmt.Errorf("%w: unverified accounts can have up to %d subscriptions", ErrVerificationRequired, limit)
+	}
+
+	return nil
+}
+
+func (h *Handler) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	// Parse the JSON request body
+	var input VerifyEmailInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if input.Token == "" {
+		http.Error(w, "Missing required field (token)", http.StatusBadRequest)
+		return
+	}
+
+	// Use up the token, only if it is still valid
+	var userID, email string
+	err := h.conn.QueryRow(
+		context.Background(),
+		"UPDATE email_verifications SET used_at = now() WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now() RETURNING user_id, email",
+		hashToken(input.Token),
+	).Scan(&userID, &email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking verification token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Only verify the address the token was sent to
+	tag, err := h.conn.Exec(
+		context.Background(),
+		"UPDATE users SET email_verified_at = COALESCE(email_verified_at, now()) WHERE id = $1 AND email = $2",
+		userID, email,
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error verifying email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+}
+
+func (h *Handler) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Get the user's verification state and when the last email was sent
+	var user User
+	var verified bool
+	var lastSent *time.Time
+	query := `
+    SELECT u.id, u.username, u.email, u.email_verified_at IS NOT NULL,
+        (SELECT MAX(ev.created_at) FROM email_verifications ev WHERE ev.user_id = u.id)
+    FROM users u
+    WHERE u.id = $1
+    `
+	if err := h.conn.QueryRow(context.Background(), query, userToken.Id).Scan(
+		&user.Id, &user.Username, &user.Email, &verified, &lastSent,
+	); err != nil {
+		http.Error(w, "Error getting user from DB", http.StatusInternalServerError)
+		return
+	}
+
+	if verified {
+		http.Error(w, ErrAlreadyVerified.Error(), http.StatusConflict)
+		return
+	}
+
+	// Throttle resends
+	if lastSent != nil {
+		if wait := time.Until(lastSent.Add(getVerificationResendWait())); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "Verification email sent recently, try again later", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if err := h.sendEmailVerification(context.Background(), user); err != nil {
+		http.Error(w, fmt.Sprintf("Error sending verification email: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Gets the user and checks their current password. Users created through an
+// identity provider have never had a password of their own, so instead their
+// session must have been started by a sign in within reauthWindow.
+func (h *Handler) checkCurrentPassword(ctx context.Context, userToken *Token, password string) (User, error) {
+	var user User
+	var hasPassword, recentLogin bool
+	query := `
+    SELECT u.id, u.username, u.email, u.password, u.role, u.has_password,
+        EXISTS (
+            SELECT 1 FROM sessions s
+            WHERE s.id = $2 AND s.user_id = u.id AND s.revoked_at IS NULL
+                AND s.created_at > now() - make_interval(secs => $3::float8)
+        )
+    FROM users u
+    WHERE u.id = $1
+    `
+	if err := h.conn.QueryRow(ctx, query, userToken.Id, userToken.SessionId, reauthWindow.Seconds()).Scan(
+		&user.Id, &user.Username, &user.Email, &user.Password, &user.Role, &hasPassword, &recentLogin,
+	); err != nil {
+		return user, fmt.Errorf("error getting user: %w", err)
+	}
+
+	if !hasPassword {
+		if !recentLogin {
+			return user, ErrReauthRequired
+		}
+		return user, nil
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return user, ErrWrongPassword
+	}
+
+	return user, nil
+}
+
+// Sends a new access token for the current session, since the old one still
+// carries the previous username and email
+func (h *Handler) writeReissuedToken(w http.ResponseWriter, user User, userToken *Token) {
+	accessToken, err := h.keys.generateJWT(user, userToken.SessionId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeTokenResponse(w, TokenResponse{
+		AccessToken: accessToken,
+		ExpiresIn:   int(getAccessTokenTTL().Seconds()),
+	})
+}
+
+func (h *Handler) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Parse the JSON request body
+	var input ChangePasswordInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields. The current password is checked below, since
+	// accounts without one sign in again instead.
+	if input.NewPassword == "" {
+		http.Error(w, "Missing required field (new_password)", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.checkCurrentPassword(context.Background(), userToken, input.CurrentPassword)
+	if errors.Is(err, ErrWrongPassword) || errors.Is(err, ErrReauthRequired) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Create password hash
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	// The password only changes if the old credentials are revoked with it
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	change := *h
+	change.conn = tx
+
+	if _, err := tx.Exec(
+		ctx,
+		"UPDATE users SET password = $2, has_password = true WHERE id = $1",
+		user.Id, hashedPassword,
+	); err != nil {
+		http.Error(w, fmt.Sprintf("Error updating password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Sign out everywhere else and revoke API keys, in case the old password
+	// was compromised
+	if err := change.revokeOtherSessions(ctx, user.Id, userToken.SessionId); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := change.revokeUserAPIKeys(ctx, user.Id); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking API keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error updating password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeReissuedToken(w, user, userToken)
+}
+
+func (h *Handler) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Parse the JSON request body
+	var input ChangeEmailInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	input.Email = strings.TrimSpace(input.Email)
+	if input.Email == "" {
+		http.Error(w, "Missing required field (email)", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.checkCurrentPassword(context.Background(), userToken, input.CurrentPassword)
+	if errors.Is(err, ErrWrongPassword) || errors.Is(err, ErrReauthRequired) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if input.Email == user.Email {
+		http.Error(w, "Email is unchanged", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// The new address has to be verified again. The unique constraint catches
+	// an address that is already taken.
+	oldEmail := user.Email
+	if _, err := tx.Exec(
+		ctx,
+		"UPDATE users SET email = $2, email_verified_at = NULL WHERE id = $1",
+		user.Id, input.Email,
+	); err != nil {
+		if isUniqueViolation(err, "email") {
+			http.Error(w, "A user with this email already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error updating email: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Reset links sent to the old address stop working
+	if _, err := tx.Exec(
+		ctx,
+		"DELETE FROM password_resets WHERE user_id = $1 AND used_at IS NULL",
+		user.Id,
+	); err != nil {
+		http.Error(w, fmt.Sprintf("Error removing reset tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error updating email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	user.Email = input.Email
+
+	if err := h.sendEmailVerification(context.Background(), user); err != nil {
+		log.Printf("Error sending verification email to user %s: %v", user.Id, err)
+	}
+
+	// Let the old address know, in case this wasn't the account owner
+	if err := h.mailer.Send(context.Background(), Mail{
+		To:      oldEmail,
+		Subject: "Your email address was changed",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nThe email address for your account was changed to %s. If you didn't make this change, reset your password and contact support.\n",
+			user.Username, user.Email,
+		),
+	}); err != nil {
+		log.Printf("Error sending email change notice to user %s: %v", user.Id, err)
+	}
+
+	h.writeReissuedToken(w, user, userToken)
+}
+
+func (h *Handler) handleChangeUsername(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Parse the JSON request body
+	var input ChangeUsernameInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	input.Username = strings.TrimSpace(input.Username)
+	if input.Username == "" {
+		http.Error(w, "Missing required field (username)", http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	if err := h.conn.QueryRow(
+		context.Background(),
+		"UPDATE users SET username = $2 WHERE id = $1 RETURNING id, username, email, role",
+		userToken.Id, input.Username,
+	).Scan(&user.Id, &user.Username, &user.Email, &user.Role); err != nil {
+		if isUniqueViolation(err, "username") {
+			http.Error(w, "A user with this username already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error updating username: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeReissuedToken(w, user, userToken)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHandleChangeUsernameReissuesToken(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("UPDATE users SET username").
+		WithArgs("u1", "new-name").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "role"}).AddRow("u1", "new-name", "test@email.com", RoleUser))
+
+	keys := newHMACKeySet("test-secret")
+	handler := &Handler{conn: mockPool, keys: keys}
+
+	req := httptest.NewRequest(http.MethodPost, "/account/username", strings.NewReader(`{"username":"new-name"}`))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1", Username: "old-name", SessionId: "s1"}))
+	w := httptest.NewRecorder()
+	handler.handleChangeUsername(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var response TokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	token, err := keys.validateJWT(response.AccessToken)
+	if err != nil {
+		t.Fatalf("Expected a valid access token: %v", err)
+	}
+	if token.Username != "new-name" || token.SessionId != "s1" {
+		t.Errorf("Unexpected claims %+v", token)
+	}
+}
+
+func TestHandleChangePasswordWrongCurrentPassword(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("current"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockPool.ExpectQuery("SELECT u.id, u.username, u.email, u.password, u.role, u.has_password").
+		WithArgs("u1", "s1", reauthWindow.Seconds()).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "password", "role", "has_password", "recent_login"}).
+			AddRow("u1", "user", "test@email.com", string(hash), RoleUser, true, true))
+
+	handler := &Handler{conn: mockPool, keys: newHMACKeySet("test-secret")}
+	req := httptest.NewRequest(http.MethodPost, "/account/password", strings.NewReader(`{"current_password":"wrong","new_password":"new"}`))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1", SessionId: "s1"}))
+	w := httptest.NewRecorder()
+	handler.handleChangePassword(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d; got %d", http.StatusForbidden, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewMailerFromEnvRequiresMailer(t *testing.T) {
+	t.Setenv("MAILER", "")
+	if _, err := newMailerFromEnv(); err == nil {
+		t.Error("Expected an error when MAILER is unset")
+	}
+
+	t.Setenv("MAILER", "log")
+	if _, err := newMailerFromEnv(); err != nil {
+		t.Errorf("Unexpected error for MAILER=log: %v", err)
+	}
+}
+
+func TestRequestPasswordResetUnknownEmail(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("SELECT u.id, u.username, u.email").
+		WithArgs("nobody@example.com").
+		WillReturnError(pgx.ErrNoRows)
+
+	// No mailer is needed since nothing is sent
+	handler := &Handler{conn: mockPool}
+	if err := handler.requestPasswordReset(context.Background(), "nobody@example.com"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A reset sent moments ago isn't replaced, so its link keeps working
+func TestRequestPasswordResetSentRecently(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	lastSent := time.Now().Add(-time.Minute)
+	mockPool.ExpectQuery("SELECT u.id, u.username, u.email").
+		WithArgs("test@email.com").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "last_sent"}).AddRow("u1", "user", "test@email.com", &lastSent))
+
+	handler := &Handler{conn: mockPool}
+	if err := handler.requestPasswordReset(context.Background(), "test@email.com"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// The token isn't used up if the old credentials can't be revoked
+func TestHandleResetPasswordRollsBack(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("UPDATE password_resets SET used_at").
+		WithArgs(hashToken("reset-token")).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow("u1"))
+	mockPool.ExpectExec("UPDATE users SET password").
+		WithArgs("u1", pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mockPool.ExpectBegin()
+	mockPool.ExpectExec("UPDATE sessions SET revoked_at").
+		WithArgs("u1").
+		WillReturnError(errors.New("connection lost"))
+	mockPool.ExpectRollback()
+	mockPool.ExpectRollback()
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/reset-password", strings.NewReader(`{"token":"reset-token","password":"new"}`))
+	w := httptest.NewRecorder()
+	handler.handleResetPassword(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d; got %d", http.StatusInternalServerError, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Accounts created through an identity provider don't know their password, so
+// a fresh sign in stands in for it. Changing it revokes API keys along with
+// other sessions.
+func TestHandleChangePasswordWithoutPassword(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("SELECT u.id, u.username, u.email, u.password, u.role, u.has_password").
+		WithArgs("u1", "s1", reauthWindow.Seconds()).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "password", "role", "has_password", "recent_login"}).
+			AddRow("u1", "user", "test@email.com", "random-hash", RoleUser, false, true))
+	mockPool.ExpectBegin()
+	mockPool.ExpectExec("UPDATE users SET password").
+		WithArgs("u1", pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mockPool.ExpectBegin()
+	mockPool.ExpectExec("UPDATE sessions SET revoked_at").
+		WithArgs("u1", "s1").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	mockPool.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+		WithArgs("u1", "s1").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	mockPool.ExpectCommit()
+	mockPool.ExpectExec("UPDATE api_keys SET revoked_at").
+		WithArgs("u1").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mockPool.ExpectCommit()
+
+	handler := &Handler{conn: mockPool, keys: newHMACKeySet("test-secret")}
+	req := httptest.NewRequest(http.MethodPost, "/account/password", strings.NewReader(`{"new_password":"new"}`))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1", SessionId: "s1"}))
+	w := httptest.NewRecorder()
+	handler.handleChangePassword(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Without a password, a stale session can't change the email, so a stolen
+// access token isn't enough to take the account over
+func TestHandleChangeEmailWithoutPasswordRequiresRecentLogin(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("SELECT u.id, u.username, u.email, u.password, u.role, u.has_password").
+		WithArgs("u1", "s1", reauthWindow.Seconds()).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "password", "role", "has_password", "recent_login"}).
+			AddRow("u1", "user", "test@email.com", "random-hash", RoleUser, false, false))
+
+	handler := &Handler{conn: mockPool, keys: newHMACKeySet("test-secret")}
+	req := httptest.NewRequest(http.MethodPost, "/account/email", strings.NewReader(`{"email":"attacker@example.com"}`))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1", SessionId: "s1"}))
+	w := httptest.NewRecorder()
+	handler.handleChangeEmail(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d; got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleChangeUsernameTaken(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("UPDATE users SET username").
+		WithArgs("u1", "taken").
+		WillReturnError(&pgconn.PgError{Code: "23505", ConstraintName: "users_username_key"})
+
+	handler := &Handler{conn: mockPool, keys: newHMACKeySet("test-secret")}
+	req := httptest.NewRequest(http.MethodPost, "/account/username", strings.NewReader(`{"username":"taken"}`))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1", SessionId: "s1"}))
+	w := httptest.NewRecorder()
+	handler.handleChangeUsername(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d; got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleChangeEmailTaken(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("current"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockPool.ExpectQuery("SELECT u.id, u.username, u.email, u.password, u.role, u.has_password").
+		WithArgs("u1", "s1", reauthWindow.Seconds()).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "password", "role", "has_password", "recent_login"}).
+			AddRow("u1", "user", "test@email.com", string(hash), RoleUser, true, true))
+	mockPool.ExpectBegin()
+	mockPool.ExpectExec("UPDATE users SET email").
+		WithArgs("u1", "taken@email.com").
+		WillReturnError(&pgconn.PgError{Code: "23505", ConstraintName: "users_email_key"})
+	mockPool.ExpectRollback()
+
+	handler := &Handler{conn: mockPool, keys: newHMACKeySet("test-secret")}
+	req := httptest.NewRequest(http.MethodPost, "/account/email", strings.NewReader(`{"email":"taken@email.com","current_password":"current"}`))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1", SessionId: "s1"}))
+	w := httptest.NewRecorder()
+	handler.handleChangeEmail(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d; got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var (
+	ErrAccountDisabled = errors.New("Account is disabled")
+	ErrAdminRequired   = errors.New("Admin role required")
+)
+
+type AdminUser struct {
+	Id            string     `json:"id"`
+	Username      string     `json:"username"`
+	Email         string     `json:"email"`
+	Role          string     `json:"role"`
+	EmailVerified bool       `json:"email_verified"`
+	DisabledAt    *time.Time `json:"disabled_at"`
+}
+
+type AdminUsersResponse struct {
+	Users []AdminUser `json:"users"`
+	Total int         `json:"total"`
+}
+
+// Escapes LIKE wildcards so a search matches them literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Middleware that only lets admins through. Must be wrapped by authMiddleware.
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken, ok := r.Context().Value(userTokenKey).(*Token)
+		if !ok {
+			http.Error(w, "No claims found in context", http.StatusForbidden)
+			return
+		}
+
+		if userToken.Role != RoleAdmin {
+			http.Error(w, ErrAdminRequired.Error(), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Deletes a user. Their sessions, keys, subscriptions etc. go with them.
+func (h *Handler) deleteUser(ctx context.Context, userID string) (bool, error) {
+	tag, err := h.conn.Exec(ctx, "DELETE FROM users WHERE id = $1", userID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (h *Handler) handleAdminGetUsers(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := getPagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Optional search on username or email
+	search := "%" + likeEscaper.Replace(r.URL.Query().Get("q")) + "%"
+
+	query := `
+    SELECT id, username, email, role, email_verified_at IS NOT NULL, disabled_at, COUNT(*) OVER ()
+    FROM users
+    WHERE username ILIKE $1 OR email ILIKE $1
+    ORDER BY email
+    LIMIT $2 OFFSET $3
+    `
+	rows, err := h.conn.Query(context.Background(), query, search, limit, offset)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting users: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	response := AdminUsersResponse{Users: []AdminUser{}}
+	for rows.Next() {
+		var user AdminUser
+		if err := rows.Scan(
+			&user.Id, &user.Username, &user.Email, &user.Role, &user.EmailVerified, &user.DisabledAt, &response.Total,
+		); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning user row: %v", err), http.StatusInternalServerError)
+			return
+		}
+		response.Users = append(response.Users, user)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating over users: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Disables or enables the user in the URL. Disabling also signs them out everywhere.
+func (h *Handler) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	userID := mux.Vars(r)["userId"]
+	if !validUUID(userID) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if disabled && userID == userToken.Id {
+		http.Error(w, "Admins can't disable their own account", http.StatusBadRequest)
+		return
+	}
+
+	// A user is only disabled once their sessions are revoked too
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	admin := *h
+	admin.conn = tx
+
+	query := "UPDATE users SET disabled_at = NULL WHERE id = $1"
+	if disabled {
+		query = "UPDATE users SET disabled_at = COALESCE(disabled_at, now()) WHERE id = $1"
+	}
+	tag, err := tx.Exec(ctx, query, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if disabled {
+		if err := admin.revokeUserSessions(ctx, userID); err != nil {
+			http.Error(w, fmt.Sprintf("Error revoking sessions: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error updating user: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) handleAdminDisableUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserDisabled(w, r, true)
+}
+
+func (h *Handler) handleAdminEnableUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserDisabled(w, r, false)
+}
+
+// Replaces the user's password with a random one, signs them out everywhere,
+// revokes their API keys and emails them a reset link
+func (h *Handler) handleAdminForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userId"]
+	if !validUUID(userID) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	randomPassword, err := randomHex(32)
+	if err != nil {
+		http.Error(w, "Error generating password", http.StatusInternalServerError)
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	// The password, sessions and API keys change together, so the account
+	// can't be left usable with its old credentials
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	admin := *h
+	admin.conn = tx
+
+	var user User
+	err = tx.QueryRow(
+		ctx,
+		"UPDATE users SET password = $2 WHERE id = $1 RETURNING id, username, email",
+		userID, hashedPassword,
+	).Scan(&user.Id, &user.Username, &user.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := admin.revokeUserSessions(ctx, user.Id); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := admin.revokeUserAPIKeys(ctx, user.Id); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking API keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error updating password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.sendPasswordReset(context.Background(), user); err != nil {
+		http.Error(w, fmt.Sprintf("Error sending password reset: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) handleAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	userID := mux.Vars(r)["userId"]
+	if !validUUID(userID) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if userID == userToken.Id {
+		http.Error(w, "Use /delete-user to delete your own account", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := h.deleteUser(context.Background(), userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Admin %s deleted user %s", userToken.Id, userID)
+}
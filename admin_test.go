@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pashagolub/pgxmock/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User ids are UUIDs
+const (
+	adminUser = "00000000-0000-0000-0000-00000000000a"
+	user1     = "00000000-0000-0000-0000-000000000001"
+	user2     = "00000000-0000-0000-0000-000000000002"
+)
+
+// Builds an admin request for a /admin/users/{userId} route
+func newAdminRequest(method string, path string, userID string) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: adminUser, Role: RoleAdmin}))
+	return mux.SetURLVars(req, map[string]string{"userId": userID})
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	tests := []struct {
+		role           string
+		expectedStatus int
+	}{
+		{RoleUser, http.StatusForbidden},
+		{"", http.StatusForbidden},
+		{RoleAdmin, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		next := adminMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+		req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1", Role: tt.role}))
+		w := httptest.NewRecorder()
+		next.ServeHTTP(w, req)
+
+		if w.Code != tt.expectedStatus {
+			t.Errorf("Role %q: expected status %d; got %d", tt.role, tt.expectedStatus, w.Code)
+		}
+	}
+}
+
+// The id query param used to select any user to delete. It must now be ignored.
+func TestHandleDeleteUserOnlyDeletesSelf(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectExec("DELETE FROM users").
+		WithArgs("u1").
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodDelete, "/delete-user?id=u2", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleDeleteUser(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d; got %d", http.StatusOK, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetUserDisabled(t *testing.T) {
+	tests := []struct {
+		name           string
+		userID         string
+		disabled       bool
+		rowsAffected   int64
+		revokeErr      error
+		expectedStatus int
+	}{
+		{"disable", user1, true, 1, nil, http.StatusOK},
+		{"enable", user1, false, 1, nil, http.StatusOK},
+		{"unknown user", user2, true, 0, nil, http.StatusNotFound},
+		{"self", adminUser, true, 0, nil, http.StatusBadRequest},
+		{"revoke fails", user1, true, 1, errors.New("connection lost"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockPool, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatalf("Failed to create mock pool: %v", err)
+			}
+			defer mockPool.Close()
+
+			if tt.userID != adminUser {
+				mockPool.ExpectBegin()
+				mockPool.ExpectExec("UPDATE users SET disabled_at").
+					WithArgs(tt.userID).
+					WillReturnResult(pgxmock.NewResult("UPDATE", tt.rowsAffected))
+			}
+			// Disabling signs the user out everywhere, or isn't applied at all
+			if tt.disabled && tt.rowsAffected > 0 {
+				mockPool.ExpectBegin()
+				if tt.revokeErr != nil {
+					mockPool.ExpectExec("UPDATE sessions SET revoked_at").
+						WithArgs(tt.userID).
+						WillReturnError(tt.revokeErr)
+					mockPool.ExpectRollback()
+				} else {
+					mockPool.ExpectExec("UPDATE sessions SET revoked_at").
+						WithArgs(tt.userID).
+						WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+					mockPool.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+						WithArgs(tt.userID).
+						WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+					mockPool.ExpectCommit()
+				}
+			}
+			if tt.userID != adminUser {
+				if tt.expectedStatus == http.StatusOK {
+					mockPool.ExpectCommit()
+				} else {
+					mockPool.ExpectRollback()
+				}
+			}
+
+			handler := &Handler{conn: mockPool}
+			w := httptest.NewRecorder()
+			handler.setUserDisabled(w, newAdminRequest(http.MethodPost, "/admin/users/"+tt.userID+"/disable", tt.userID), tt.disabled)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d; got %d", tt.expectedStatus, w.Code)
+			}
+			if err := mockPool.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestHandleAdminForcePasswordReset(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("UPDATE users SET password").
+		WithArgs(user1, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email"}).AddRow(user1, "user", "test@email.com"))
+	mockPool.ExpectBegin()
+	mockPool.ExpectExec("UPDATE sessions SET revoked_at").
+		WithArgs(user1).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mockPool.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+		WithArgs(user1).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mockPool.ExpectCommit()
+	// API keys would otherwise keep working after the reset
+	mockPool.ExpectExec("UPDATE api_keys SET revoked_at").
+		WithArgs(user1).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mockPool.ExpectCommit()
+	mockPool.ExpectExec("UPDATE password_resets SET used_at").
+		WithArgs(user1).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	mockPool.ExpectExec("INSERT INTO password_resets").
+		WithArgs(user1, pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	dir := t.TempDir()
+	handler := &Handler{conn: mockPool, mailer: &fileMailer{from: "reader@example.com", dir: dir}}
+	w := httptest.NewRecorder()
+	handler.handleAdminForcePasswordReset(w, newAdminRequest(http.MethodPost, "/admin/users/u1/reset-password", user1))
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected status %d; got %d", http.StatusAccepted, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 reset email; got %d", len(files))
+	}
+	mail, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(mail), "To: test@email.com") {
+		t.Errorf("Expected reset email to be sent to the user:\n%s", mail)
+	}
+}
+
+func TestHandleAdminForcePasswordResetUnknownUser(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("UPDATE users SET password").
+		WithArgs(user2, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email"}))
+	mockPool.ExpectRollback()
+
+	handler := &Handler{conn: mockPool}
+	w := httptest.NewRecorder()
+	handler.handleAdminForcePasswordReset(w, newAdminRequest(http.MethodPost, "/admin/users/u2/reset-password", user2))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d; got %d", http.StatusNotFound, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleAdminDeleteUser(t *testing.T) {
+	tests := []struct {
+		name           string
+		userID         string
+		rowsAffected   int64
+		expectedStatus int
+	}{
+		{"other user", user1, 1, http.StatusOK},
+		{"unknown user", user2, 0, http.StatusNotFound},
+		{"self", adminUser, 0, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockPool, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatalf("Failed to create mock pool: %v", err)
+			}
+			defer mockPool.Close()
+
+			if tt.userID != adminUser {
+				mockPool.ExpectExec("DELETE FROM users").
+					WithArgs(tt.userID).
+					WillReturnResult(pgxmock.NewResult("DELETE", tt.rowsAffected))
+			}
+
+			handler := &Handler{conn: mockPool}
+			w := httptest.NewRecorder()
+			handler.handleAdminDeleteUser(w, newAdminRequest(http.MethodDelete, "/admin/users/"+tt.userID, tt.userID))
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d; got %d", tt.expectedStatus, w.Code)
+			}
+			if err := mockPool.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Ids that aren't UUIDs are not found rather than failing the cast in Postgres
+func TestAdminHandlersInvalidUserID(t *testing.T) {
+	tests := []struct {
+		name   string
+		handle func(h *Handler, w http.ResponseWriter, r *http.Request)
+	}{
+		{"disable", (*Handler).handleAdminDisableUser},
+		{"force password reset", (*Handler).handleAdminForcePasswordReset},
+		{"delete", (*Handler).handleAdminDeleteUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockPool, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatalf("Failed to create mock pool: %v", err)
+			}
+			defer mockPool.Close()
+
+			handler := &Handler{conn: mockPool}
+			w := httptest.NewRecorder()
+			tt.handle(handler, w, newAdminRequest(http.MethodPost, "/admin/users/not-a-uuid", "not-a-uuid"))
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected status %d; got %d", http.StatusNotFound, w.Code)
+			}
+			if err := mockPool.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Every way of signing in must refuse a disabled account. The lookups filter
+// disabled users out, so they find nothing.
+func TestDisabledAccountRejected(t *testing.T) {
+	t.Run("login", func(t *testing.T) {
+		mockPool, err := pgxmock.NewPool()
+		if err != nil {
+			t.Fatalf("Failed to create mock pool: %v", err)
+		}
+		defer mockPool.Close()
+
+		hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mockPool.ExpectQuery("SELECT locked_until FROM login_failures").
+			WithArgs("test@email.com").
+			WillReturnRows(pgxmock.NewRows([]string{"locked_until"}))
+		mockPool.ExpectQuery("SELECT id, username, email, password, role, disabled_at IS NOT NULL FROM users").
+			WithArgs("test@email.com").
+			WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "password", "role", "disabled"}).
+				AddRow("u1", "user", "test@email.com", string(hash), RoleUser, true))
+
+		handler := &Handler{conn: mockPool}
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email":"test@email.com","password":"password"}`))
+		w := httptest.NewRecorder()
+		handler.handleLogin(w, req)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d; got %d", http.StatusForbidden, w.Code)
+		}
+		if err := mockPool.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		mockPool, err := pgxmock.NewPool()
+		if err != nil {
+			t.Fatalf("Failed to create mock pool: %v", err)
+		}
+		defer mockPool.Close()
+
+		tokenHash := hashToken("refresh-token")
+		mockPool.ExpectBegin()
+		mockPool.ExpectQuery(`(?s)UPDATE refresh_tokens rt.+u\.disabled_at IS NULL`).
+			WithArgs(tokenHash).
+			WillReturnRows(pgxmock.NewRows([]string{"family_id", "id", "username", "email", "role"}))
+		mockPool.ExpectRollback()
+		mockPool.ExpectQuery("SELECT family_id FROM refresh_tokens").
+			WithArgs(tokenHash).
+			WillReturnRows(pgxmock.NewRows([]string{"family_id"}))
+
+		handler := &Handler{conn: mockPool}
+		if _, err := handler.rotateRefreshToken(context.Background(), "refresh-token"); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("Expected %v; got %v", ErrInvalidRefreshToken, err)
+		}
+		if err := mockPool.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("API key", func(t *testing.T) {
+		mockPool, err := pgxmock.NewPool()
+		if err != nil {
+			t.Fatalf("Failed to create mock pool: %v", err)
+		}
+		defer mockPool.Close()
+
+		key := apiKeyPrefix + "secret"
+		mockPool.ExpectQuery(`(?s)UPDATE api_keys k.+u\.disabled_at IS NULL`).
+			WithArgs(hashToken(key)).
+			WillReturnRows(pgxmock.NewRows([]string{"id", "scopes", "id", "username", "email", "role"}))
+
+		handler := &Handler{conn: mockPool}
+		if _, err := handler.authenticateAPIKey(context.Background(), key, http.MethodGet); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Errorf("Expected %v; got %v", ErrInvalidAPIKey, err)
+		}
+		if err := mockPool.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("2FA", func(t *testing.T) {
+		mockPool, err := pgxmock.NewPool()
+		if err != nil {
+			t.Fatalf("Failed to create mock pool: %v", err)
+		}
+		defer mockPool.Close()
+
+		mockPool.ExpectQuery(`(?s)UPDATE login_challenges c.+u\.disabled_at IS NULL`).
+			WithArgs(hashToken("challenge"), maxChallengeAttempts).
+			WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "role"}))
+
+		handler := &Handler{conn: mockPool}
+		req := httptest.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader(`{"challenge_token":"challenge","code":"123456"}`))
+		w := httptest.NewRecorder()
+		handler.handleLoginTwoFactor(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+		if err := mockPool.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
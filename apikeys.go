@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	apiKeyPrefix        = "rk_"
+	apiKeyDisplayLength = 8
+	maxAPIKeyNameLength = 100
+)
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+var (
+	ErrInvalidAPIKey     = errors.New("invalid API key")
+	ErrInsufficientScope = errors.New("API key doesn't have the required scope")
+	ErrSessionRequired   = errors.New("this endpoint can't be used with an API key")
+)
+
+var validAPIKeyScopes = []string{ScopeRead, ScopeWrite}
+
+// Methods that only need the read scope; everything else needs write
+var readOnlyMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+type APIKey struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	// Only set in the response to creating the key
+	Key string `json:"key,omitempty"`
+}
+
+type CreateAPIKeyInput struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Lifetime of the key, e.g. "720h". Keys without one don't expire.
+	ExpiresIn string `json:"expires_in"`
+}
+
+// Returns the scope a request method needs
+func requiredScope(method string) string {
+	if readOnlyMethods[method] {
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+// Looks up an unrevoked, unexpired API key, records its use and returns a token
+// for its owner
+func (h *Handler) authenticateAPIKey(ctx context.Context, key string, method string) (*Token, error) {
+	var token Token
+	var scopes []string
+	query := `
+    UPDATE api_keys k
+    SET last_used_at = now()
+    FROM users u
+    WHERE k.key_hash = $1
+        AND k.revoked_at IS NULL
+        AND (k.expires_at IS NULL OR k.expires_at > now())
+        AND u.id = k.user_id
+        AND u.disabled_at IS NULL
+    RETURNING k.id, k.scopes, u.id, u.username, u.email, u.role
+    `
+	err := h.conn.QueryRow(ctx, query, hashToken(key)).Scan(&token.ApiKeyId, &scopes, &token.Id, &token.Username, &token.Email, &token.Role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error checking API key: %w", err)
+	}
+
+	if !slices.Contains(scopes, requiredScope(method)) {
+		return nil, ErrInsufficientScope
+	}
+
+	return &token, nil
+}
+
+// Middleware that refuses requests authenticated with an API key, for endpoints
+// that manage the account itself. Must be wrapped by authMiddleware.
+func requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken, ok := r.Context().Value(userTokenKey).(*Token)
+		if !ok {
+			http.Error(w, "No claims found in context", http.StatusForbidden)
+			return
+		}
+
+		if userToken.ApiKeyId != "" {
+			http.Error(w, ErrSessionRequired.Error(), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Parse the JSON request body
+	var input CreateAPIKeyInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate fields
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		http.Error(w, "Missing required field (name)", http.StatusBadRequest)
+		return
+	}
+	if len(input.Name) > maxAPIKeyNameLength {
+		http.Error(w, fmt.Sprintf("Name must be at most %d characters", maxAPIKeyNameLength), http.StatusBadRequest)
+		return
+	}
+
+	scopes := input.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{ScopeRead}
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(validAPIKeyScopes, scope) {
+			http.Error(w, fmt.Sprintf("Invalid scope %q", scope), http.StatusBadRequest)
+			return
+		}
+	}
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+
+	var expiresAt *time.Time
+	if input.ExpiresIn != "" {
+		ttl, err := time.ParseDuration(input.ExpiresIn)
+		if err != nil || ttl <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid expires_in %q", input.ExpiresIn), http.StatusBadRequest)
+			return
+		}
+		t := time.Now().Add(ttl)
+		expiresAt = &t
+	}
+
+	secret, _, err := newOpaqueToken()
+	if err != nil {
+		http.Error(w, "Error generating API key", http.StatusInternalServerError)
+		return
+	}
+	key := apiKeyPrefix + secret
+
+	apiKey := APIKey{Key: key}
+	query := `
+    INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+    VALUES (@user_id, @name, @prefix, @key_hash, @scopes, @expires_at)
+    RETURNING id, name, prefix, scopes, created_at, last_used_at, expires_at
+    `
+	args := pgx.NamedArgs{
+		"user_id":    userToken.Id,
+		"name":       input.Name,
+		"prefix":     key[:len(apiKeyPrefix)+apiKeyDisplayLength],
+		"key_hash":   hashToken(key),
+		"scopes":     scopes,
+		"expires_at": expiresAt,
+	}
+	if err := h.conn.QueryRow(context.Background(), query, args).Scan(
+		&apiKey.Id, &apiKey.Name, &apiKey.Prefix, &apiKey.Scopes, &apiKey.CreatedAt, &apiKey.LastUsedAt, &apiKey.ExpiresAt,
+	); err != nil {
+		http.Error(w, fmt.Sprintf("Error adding API key to database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The key is only ever shown in this response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apiKey)
+}
+
+func (h *Handler) handleGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	query := `
+    SELECT id, name, prefix, scopes, created_at, last_used_at, expires_at
+    FROM api_keys
+    WHERE user_id = $1 AND revoked_at IS NULL
+    ORDER BY created_at DESC
+    `
+	rows, err := h.conn.Query(context.Background(), query, userToken.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting API keys for user %s: %v", userToken.Id, err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	apiKeys := []APIKey{}
+	for rows.Next() {
+		var apiKey APIKey
+		if err := rows.Scan(
+			&apiKey.Id, &apiKey.Name, &apiKey.Prefix, &apiKey.Scopes, &apiKey.CreatedAt, &apiKey.LastUsedAt, &apiKey.ExpiresAt,
+		); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning API key row: %v", err), http.StatusInternalServerError)
+			return
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating over API keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiKeys)
+}
+
+// Revokes all of a user's API keys, e.g. when their password changes
+func (h *Handler) revokeUserAPIKeys(ctx context.Context, userID string) error {
+	_, err := h.conn.Exec(ctx, "UPDATE api_keys SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	return err
+}
+
+func (h *Handler) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	keyID := mux.Vars(r)["keyId"]
+	if !validUUID(keyID) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	tag, err := h.conn.Exec(
+		context.Background(),
+		"UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		keyID, userToken.Id,
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking API key: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestAuthMiddlewareAPIKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		scopes         []string
+		found          bool
+		expectedStatus int
+	}{
+		{"read key on GET", http.MethodGet, []string{ScopeRead}, true, http.StatusOK},
+		{"read key on POST", http.MethodPost, []string{ScopeRead}, true, http.StatusForbidden},
+		{"write key on DELETE", http.MethodDelete, []string{ScopeRead, ScopeWrite}, true, http.StatusOK},
+		{"unknown or revoked key", http.MethodGet, nil, false, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockPool, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatalf("Failed to create mock pool: %v", err)
+			}
+			defer mockPool.Close()
+
+			key := apiKeyPrefix + "secret"
+			rows := pgxmock.NewRows([]string{"id", "scopes", "id", "username", "email", "role"})
+			if tt.found {
+				rows.AddRow("k1", tt.scopes, "u1", "user", "test@email.com", RoleUser)
+			}
+			mockPool.ExpectQuery("UPDATE api_keys k").
+				WithArgs(hashToken(key)).
+				WillReturnRows(rows)
+
+			handler := &Handler{conn: mockPool}
+			var token *Token
+			next := handler.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				token, _ = r.Context().Value(userTokenKey).(*Token)
+			})
+
+			req := httptest.NewRequest(tt.method, "/user-subscriptions", nil)
+			req.Header.Set("Authorization", "Bearer "+key)
+			w := httptest.NewRecorder()
+			next.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d; got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus == http.StatusOK && (token == nil || token.Id != "u1" || token.ApiKeyId != "k1") {
+				t.Errorf("Unexpected token in context: %+v", token)
+			}
+			if err := mockPool.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRequireSessionRejectsAPIKey(t *testing.T) {
+	called := false
+	next := requireSession(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1", ApiKeyId: "k1"}))
+	w := httptest.NewRecorder()
+	next.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d; got %d", http.StatusForbidden, w.Code)
+	}
+	if called {
+		t.Error("Expected the next handler not to be called")
+	}
+}
+
+func TestHandleRevokeAPIKeyInvalidID(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	handler := &Handler{conn: mock}
+	req := httptest.NewRequest(http.MethodDelete, "/api-keys/abc", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1", SessionId: "s1"}))
+	req = mux.SetURLVars(req, map[string]string{"keyId": "abc"})
+	w := httptest.NewRecorder()
+	handler.handleRevokeAPIKey(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d; got %d", http.StatusNotFound, w.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
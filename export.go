@@ -0,0 +1,355 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultDataExportTTL = 7 * 24 * time.Hour
+	dataExportTimeout    = 10 * time.Minute
+)
+
+const (
+	ExportPending  = "pending"
+	ExportRunning  = "running"
+	ExportComplete = "complete"
+	ExportFailed   = "failed"
+)
+
+type DataExport struct {
+	Id          string     `json:"id"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	DownloadUrl string     `json:"download_url,omitempty"`
+}
+
+// A JSON file in the export archive and the query producing it. Each query
+// returns a single JSON value for the user in $1.
+type exportFile struct {
+	name  string
+	query string
+}
+
+var exportFiles = []exportFile{
+	{"profile.json", `
+    SELECT row_to_json(t) FROM (
+        SELECT id, username, email, role, email_verified_at, disabled_at
+        FROM users WHERE id = $1
+    ) t
+    `},
+	{"folders.json", `
+    SELECT COALESCE(json_agg(t ORDER BY t.sort_order, t.name), '[]') FROM (
+        SELECT id, name, parent_id, sort_order FROM folders WHERE user_id = $1
+    ) t
+    `},
+	{"subscriptions.json", `
+    SELECT COALESCE(json_agg(t ORDER BY t.url), '[]') FROM (
+        SELECT s.id, f.url, f.title AS feed_title, s.title, s.folder_id, s.notify, s.display_mode,
+            s.retention_days, f.last_checked
+        FROM subscriptions s JOIN feeds f ON f.id = s.feed_id
+        WHERE s.user_id = $1
+    ) t
+    `},
+	{"read_states.json", `
+    SELECT COALESCE(json_agg(t ORDER BY t.item_id), '[]') FROM (
+        SELECT st.item_id, f.url AS feed_url, i.guid, i.title, i.link, st.read, st.read_at
+        FROM item_states st
+        JOIN items i ON i.id = st.item_id
+        JOIN feeds f ON f.id = i.feed_id
+        WHERE st.user_id = $1
+    ) t
+    `},
+	{"starred_items.json", `
+    SELECT COALESCE(json_agg(t ORDER BY t.starred_at), '[]') FROM (
+        SELECT si.item_id, f.url AS feed_url, i.guid, i.title, i.link, i.author, i.published,
+            i.description, i.content, si.starred_at
+        FROM starred_items si
+        JOIN items i ON i.id = si.item_id
+        JOIN feeds f ON f.id = i.feed_id
+        WHERE si.user_id = $1
+    ) t
+    `},
+	{"settings.json", `
+    SELECT json_build_object(
+        'two_factor_enabled', EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL),
+        'api_keys', (
+            SELECT COALESCE(json_agg(k ORDER BY k.created_at), '[]') FROM (
+                SELECT id, name, prefix, scopes, created_at, last_used_at, expires_at, revoked_at
+                FROM api_keys WHERE user_id = $1
+            ) k
+        ),
+        'linked_identities', (
+            SELECT COALESCE(json_agg(i ORDER BY i.created_at), '[]') FROM (
+                SELECT issuer, subject, created_at FROM user_identities WHERE user_id = $1
+            ) i
+        ),
+        'sessions', (
+            SELECT COALESCE(json_agg(s ORDER BY s.created_at), '[]') FROM (
+                SELECT id, user_agent, ip, created_at, last_seen_at, revoked_at
+                FROM sessions WHERE user_id = $1
+            ) s
+        )
+    )
+    `},
+}
+
+// Reads how long finished exports can be downloaded from DATA_EXPORT_TTL
+func getDataExportTTL() time.Duration {
+	return getDurationEnv("DATA_EXPORT_TTL", defaultDataExportTTL)
+}
+
+// Builds the zip archive of everything stored for a user
+func (h *Handler) buildDataExport(ctx context.Context, userID string) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	for _, file := range exportFiles {
+		var data json.RawMessage
+		if err := h.conn.QueryRow(ctx, file.query, userID).Scan(&data); err != nil {
+			return nil, fmt.Errorf("error exporting %s: %w", file.name, err)
+		}
+
+		// Re-indent so the files are readable
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, data, "", "  "); err != nil {
+			return nil, fmt.Errorf("error formatting %s: %w", file.name, err)
+		}
+
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pretty.WriteTo(f); err != nil {
+			return nil, err
+		}
+	}
+
+	doc, err := h.buildOPML(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := archive.Create("subscriptions.opml")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeOPML(f, doc); err != nil {
+		return nil, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Generates an export and stores the archive or the error
+func (h *Handler) runDataExport(exportID string, userID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dataExportTimeout)
+	defer cancel()
+
+	if _, err := h.conn.Exec(ctx, "UPDATE data_exports SET status = $2 WHERE id = $1", exportID, ExportRunning); err != nil {
+		log.Printf("Error starting data export %s: %v", exportID, err)
+		return
+	}
+
+	archive, err := h.buildDataExport(ctx, userID)
+	if err != nil {
+		log.Printf("Error building data export %s: %v", exportID, err)
+		if _, err := h.conn.Exec(
+			context.Background(),
+			"UPDATE data_exports SET status = $2, error = $3, completed_at = now() WHERE id = $1",
+			exportID, ExportFailed, "Export failed, please try again",
+		); err != nil {
+			log.Printf("Error recording failed data export %s: %v", exportID, err)
+		}
+		return
+	}
+
+	if _, err := h.conn.Exec(
+		ctx,
+		"UPDATE data_exports SET status = $2, archive = $3, completed_at = now(), expires_at = $4 WHERE id = $1",
+		exportID, ExportComplete, archive, time.Now().Add(getDataExportTTL()),
+	); err != nil {
+		log.Printf("Error storing data export %s: %v", exportID, err)
+	}
+}
+
+// Marks exports that have been in progress for longer than an export can run as
+// failed, since the server running them must have stopped. Newer ones may still
+// be running on another instance, so they're left alone.
+func (h *Handler) failInterruptedExports(ctx context.Context) error {
+	query := `
+    UPDATE data_exports SET status = $1, error = $2, completed_at = now()
+    WHERE status IN ($3, $4) AND created_at < now() - make_interval(secs => $5::float8)
+    `
+	_, err := h.conn.Exec(
+		ctx, query,
+		ExportFailed, "Export was interrupted, please try again", ExportPending, ExportRunning, dataExportTimeout.Seconds(),
+	)
+	return err
+}
+
+// Fails interrupted exports until ctx is cancelled
+func (h *Handler) sweepInterruptedExports(ctx context.Context) {
+	ticker := time.NewTicker(dataExportTimeout)
+	defer ticker.Stop()
+
+	for {
+		if err := h.failInterruptedExports(ctx); err != nil {
+			log.Printf("Error clearing interrupted data exports: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Gets the user's pending or running export. There is at most one.
+func (h *Handler) getExportInProgress(ctx context.Context, userID string) (DataExport, error) {
+	var export DataExport
+	err := h.conn.QueryRow(
+		ctx,
+		"SELECT id, status, created_at FROM data_exports WHERE user_id = $1 AND status IN ($2, $3)",
+		userID, ExportPending, ExportRunning,
+	).Scan(&export.Id, &export.Status, &export.CreatedAt)
+	return export, err
+}
+
+func (h *Handler) handleCreateDataExport(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Return the export already in progress, if any
+	export, err := h.getExportInProgress(context.Background(), userToken.Id)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, fmt.Sprintf("Error checking data exports: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Only the latest export is kept
+		if _, err := h.conn.Exec(
+			context.Background(),
+			"DELETE FROM data_exports WHERE user_id = $1 AND status NOT IN ($2, $3)",
+			userToken.Id, ExportPending, ExportRunning,
+		); err != nil {
+			http.Error(w, fmt.Sprintf("Error removing old data exports: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		err := h.conn.QueryRow(
+			context.Background(),
+			"INSERT INTO data_exports (user_id) VALUES ($1) RETURNING id, status, created_at",
+			userToken.Id,
+		).Scan(&export.Id, &export.Status, &export.CreatedAt)
+		if isUniqueViolation(err, "data_exports_in_progress") {
+			// A concurrent request started one first
+			export, err = h.getExportInProgress(context.Background(), userToken.Id)
+		} else if err == nil {
+			go h.runDataExport(export.Id, userToken.Id)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error creating data export: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/account/export/"+export.Id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(export)
+}
+
+func (h *Handler) handleGetDataExport(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	exportID := mux.Vars(r)["exportId"]
+	if !validUUID(exportID) {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	var export DataExport
+	err := h.conn.QueryRow(
+		context.Background(),
+		"SELECT id, status, error, created_at, completed_at, expires_at FROM data_exports WHERE id = $1 AND user_id = $2",
+		exportID, userToken.Id,
+	).Scan(&export.Id, &export.Status, &export.Error, &export.CreatedAt, &export.CompletedAt, &export.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting data export: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if export.Status == ExportComplete && export.ExpiresAt != nil && time.Now().Before(*export.ExpiresAt) {
+		export.DownloadUrl = "/account/export/" + export.Id + "/download"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(export)
+}
+
+func (h *Handler) handleDownloadDataExport(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	exportID := mux.Vars(r)["exportId"]
+	if !validUUID(exportID) {
+		http.Error(w, "Export not found or not ready", http.StatusNotFound)
+		return
+	}
+
+	var archive []byte
+	var createdAt time.Time
+	err := h.conn.QueryRow(
+		context.Background(),
+		"SELECT archive, created_at FROM data_exports WHERE id = $1 AND user_id = $2 AND status = $3 AND expires_at > now()",
+		exportID, userToken.Id, ExportComplete,
+	).Scan(&archive, &createdAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Export not found or not ready", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting data export: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="reader-export-%s.zip"`, createdAt.Format("2006-01-02")))
+	w.Write(archive)
+}
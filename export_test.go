@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestBuildDataExport(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	for _, file := range exportFiles {
+		mockPool.ExpectQuery(regexp.QuoteMeta(file.query)).
+			WithArgs("u1").
+			WillReturnRows(pgxmock.NewRows([]string{"data"}).AddRow([]byte(`{"file":"` + file.name + `"}`)))
+	}
+	mockPool.ExpectQuery("SELECT id, name, parent_id FROM folders").
+		WithArgs("u1").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "name", "parent_id"}))
+	mockPool.ExpectQuery("FROM subscriptions s").
+		WithArgs("u1").
+		WillReturnRows(pgxmock.NewRows([]string{"title", "url", "folder_id"}).
+			AddRow("Example", "https://example.com/feed.xml", (*string)(nil)))
+
+	handler := &Handler{conn: mockPool}
+	archive, err := handler.buildDataExport(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("Export isn't a valid zip: %v", err)
+	}
+
+	files := map[string][]byte{}
+	for _, f := range reader.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+
+	for _, file := range exportFiles {
+		var data map[string]string
+		if err := json.Unmarshal(files[file.name], &data); err != nil || data["file"] != file.name {
+			t.Errorf("Unexpected contents of %s: %s", file.name, files[file.name])
+		}
+	}
+	if !bytes.Contains(files["subscriptions.opml"], []byte("https://example.com/feed.xml")) {
+		t.Errorf("Expected subscriptions.opml to list the subscription; got %s", files["subscriptions.opml"])
+	}
+}
+
+// When a concurrent request starts an export first, its export is returned
+// rather than starting another
+func TestHandleCreateDataExportConcurrent(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	columns := []string{"id", "status", "created_at"}
+	mockPool.ExpectQuery("SELECT id, status, created_at FROM data_exports").
+		WithArgs("u1", ExportPending, ExportRunning).
+		WillReturnRows(pgxmock.NewRows(columns))
+	mockPool.ExpectExec("DELETE FROM data_exports").
+		WithArgs("u1", ExportPending, ExportRunning).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mockPool.ExpectQuery("INSERT INTO data_exports").
+		WithArgs("u1").
+		WillReturnError(&pgconn.PgError{Code: "23505", ConstraintName: "data_exports_in_progress_idx"})
+	mockPool.ExpectQuery("SELECT id, status, created_at FROM data_exports").
+		WithArgs("u1", ExportPending, ExportRunning).
+		WillReturnRows(pgxmock.NewRows(columns).AddRow("e1", ExportPending, time.Now()))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/account/export", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleCreateDataExport(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d; got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	if location := w.Header().Get("Location"); location != "/account/export/e1" {
+		t.Errorf("Expected the existing export; got %q", location)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDataExportHandlersInvalidID(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	handler := &Handler{conn: mock}
+	handlers := []func(*Handler, http.ResponseWriter, *http.Request){
+		(*Handler).handleGetDataExport,
+		(*Handler).handleDownloadDataExport,
+	}
+
+	for _, handle := range handlers {
+		req := httptest.NewRequest(http.MethodGet, "/account/exports/abc", nil)
+		req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1", SessionId: "s1"}))
+		req = mux.SetURLVars(req, map[string]string{"exportId": "abc"})
+		w := httptest.NewRecorder()
+		handle(handler, w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d; got %d", http.StatusNotFound, w.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+// Only exports older than any run could take are failed, since newer ones may
+// belong to another instance
+func TestFailInterruptedExports(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectExec(regexp.QuoteMeta("created_at < now() - make_interval(secs => $5::float8)")).
+		WithArgs(ExportFailed, pgxmock.AnyArg(), ExportPending, ExportRunning, dataExportTimeout.Seconds()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	handler := &Handler{conn: mockPool}
+	if err := handler.failInterruptedExports(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// Sort order that puts a new folder after the user's existing ones. Expects the user id in $1.
+const nextFolderSortOrder = "(SELECT COALESCE(MAX(sort_order), 0) + 1 FROM folders WHERE user_id = $1)"
+
+// Selects the id of the folder in @folder_id and of all its subfolders, if it
+// belongs to the user in @user_id. UNION stops the recursion if the parents
+// ever form a cycle.
+const folderTreeQuery = `
+    WITH RECURSIVE tree AS (
+        SELECT id FROM folders WHERE id = @folder_id AND user_id = @user_id
+        UNION
+        SELECT f.id FROM folders f JOIN tree t ON f.parent_id = t.id
+    )
+    SELECT id FROM tree`
+
+type RenameFolderInput struct {
+	Name string `json:"name"`
+}
+
+type ReorderFoldersInput struct {
+	FolderIds []string `json:"folder_ids"`
+}
+
+type MoveFolderInput struct {
+	// New parent folder, or null to move the folder to the top level
+	ParentId *string `json:"parent_id"`
+}
+
+type MoveSubscriptionsInput struct {
+	SubscriptionIds []int `json:"subscription_ids"`
+	// Destination folder, or null to unfile the subscriptions
+	FolderId *string `json:"folder_id"`
+}
+
+// Reports whether the folder exists and belongs to the user. Ids that aren't
+// UUIDs can't exist, so aren't looked up.
+func (h *Handler) folderExists(ctx context.Context, userID string, folderID string) (bool, error) {
+	if !validUUID(folderID) {
+		return false, nil
+	}
+
+	var exists bool
+	err := h.conn.QueryRow(
+		ctx,
+		"SELECT EXISTS(SELECT 1 FROM folders WHERE id = $1 AND user_id = $2)",
+		folderID, userID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// Locks the user's folders until the end of the transaction, so concurrent
+// changes to the hierarchy can't together form a cycle
+func (h *Handler) lockFolders(ctx context.Context, userID string) error {
+	_, err := h.conn.Exec(ctx, "SELECT 1 FROM folders WHERE user_id = $1 FOR UPDATE", userID)
+	return err
+}
+
+// Nests folders under their parents, keeping the order they were given in.
+// A folder's unread count includes its subfolders.
+func buildFolderTree(folders []UserFolder) []UserFolder {
+	ids := map[string]bool{}
+	for _, folder := range folders {
+		ids[folder.Id] = true
+	}
+
+	var roots []int
+	children := map[string][]int{}
+	for i, folder := range folders {
+		if folder.ParentId != nil && ids[*folder.ParentId] {
+			children[*folder.ParentId] = append(children[*folder.ParentId], i)
+		} else {
+			roots = append(roots, i)
+		}
+	}
+
+	visited := make([]bool, len(folders))
+	var build func(i int) UserFolder
+	build = func(i int) UserFolder {
+		visited[i] = true
+		folder := folders[i]
+		for _, child := range children[folder.Id] {
+			if visited[child] {
+				continue
+			}
+			subfolder := build(child)
+			folder.UnreadCount += subfolder.UnreadCount
+			folder.Children = append(folder.Children, subfolder)
+		}
+		return folder
+	}
+
+	tree := []UserFolder{}
+	for _, i := range roots {
+		tree = append(tree, build(i))
+	}
+	// Folders whose parents form a cycle can't be reached from the top level
+	for i := range folders {
+		if !visited[i] {
+			tree = append(tree, build(i))
+		}
+	}
+
+	return tree
+}
+
+func (h *Handler) handleRenameFolder(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	folderId := mux.Vars(r)["folderId"]
+	if !validUUID(folderId) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	// Parse the JSON request body
+	var input RenameFolderInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" {
+		http.Error(w, "Missing required field (name)", http.StatusBadRequest)
+		return
+	}
+
+	var folder UserFolder
+	err := h.conn.QueryRow(
+		context.Background(),
+		"UPDATE folders SET name = $3 WHERE id = $2 AND user_id = $1 RETURNING id, name, parent_id, sort_order",
+		userToken.Id, folderId, input.Name,
+	).Scan(&folder.Id, &folder.Name, &folder.ParentId, &folder.SortOrder)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error renaming folder: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(folder)
+}
+
+// Deletes a folder. Its subscriptions are moved to the folder in the move_to
+// query param, or unfiled if there isn't one, and its subfolders are moved up
+// to its parent.
+func (h *Handler) handleDeleteFolder(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	folderId := mux.Vars(r)["folderId"]
+	if !validUUID(folderId) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	// The moves and the delete happen together or not at all
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	folders := *h
+	folders.conn = tx
+
+	// Subfolders are moved below, so hold off concurrent moves
+	if err := folders.lockFolders(ctx, userToken.Id); err != nil {
+		http.Error(w, fmt.Sprintf("Error locking folders: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	exists, err := folders.folderExists(ctx, userToken.Id, folderId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting folder: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	var moveTo *string
+	if value := r.URL.Query().Get("move_to"); value != "" {
+		if value == folderId {
+			http.Error(w, "Can't move subscriptions to the folder being deleted", http.StatusBadRequest)
+			return
+		}
+
+		exists, err := folders.folderExists(ctx, userToken.Id, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting folder: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Destination folder not found", http.StatusBadRequest)
+			return
+		}
+		moveTo = &value
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		"UPDATE subscriptions SET folder_id = $3 WHERE folder_id = $2 AND user_id = $1",
+		userToken.Id, folderId, moveTo,
+	); err != nil {
+		http.Error(w, fmt.Sprintf("Error moving subscriptions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		"UPDATE folders SET parent_id = (SELECT parent_id FROM folders WHERE id = $2) WHERE parent_id = $2 AND user_id = $1",
+		userToken.Id, folderId,
+	); err != nil {
+		http.Error(w, fmt.Sprintf("Error moving subfolders: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		"DELETE FROM folders WHERE id = $2 AND user_id = $1",
+		userToken.Id, folderId,
+	); err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting folder: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting folder: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Sets the folder order to the order of folder_ids. Folders not listed keep
+// their relative order after the listed ones.
+func (h *Handler) handleReorderFolders(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Parse the JSON request body
+	var input ReorderFoldersInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if len(input.FolderIds) == 0 {
+		http.Error(w, "Missing required field (folder_ids)", http.StatusBadRequest)
+		return
+	}
+	seen := map[string]bool{}
+	for _, id := range input.FolderIds {
+		if seen[id] {
+			http.Error(w, fmt.Sprintf("Duplicate folder id %s", id), http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+	}
+
+	// Check every folder belongs to the user
+	var count int
+	if err := h.conn.QueryRow(
+		context.Background(),
+		"SELECT COUNT(*) FROM folders WHERE user_id = $1 AND id::text = ANY($2)",
+		userToken.Id, input.FolderIds,
+	).Scan(&count); err != nil {
+		http.Error(w, fmt.Sprintf("Error getting folders: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if count != len(input.FolderIds) {
+		http.Error(w, "Unknown folder id", http.StatusBadRequest)
+		return
+	}
+
+	query := `
+    UPDATE folders f
+    SET sort_order = CASE
+        WHEN o.position IS NOT NULL THEN o.position
+        ELSE $3 + f.sort_order
+    END
+    FROM folders f2
+    LEFT JOIN unnest($2::text[]) WITH ORDINALITY AS o(id, position) ON o.id = f2.id::text
+    WHERE f.id = f2.id AND f.user_id = $1
+    `
+	if _, err := h.conn.Exec(context.Background(), query, userToken.Id, input.FolderIds, len(input.FolderIds)+1); err != nil {
+		http.Error(w, fmt.Sprintf("Error reordering folders: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Moves a folder under another folder, or to the top level if parent_id is
+// null. A folder can't be moved into itself or one of its subfolders.
+func (h *Handler) handleMoveFolder(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	folderId := mux.Vars(r)["folderId"]
+	if !validUUID(folderId) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	// Parse the JSON request body
+	var input MoveFolderInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// The cycle check and the move happen in one transaction, with the user's
+	// folders locked so two moves can't each pass the check and together form
+	// a cycle
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	folders := *h
+	folders.conn = tx
+
+	if err := folders.lockFolders(ctx, userToken.Id); err != nil {
+		http.Error(w, fmt.Sprintf("Error locking folders: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if input.ParentId != nil {
+		exists, err := folders.folderExists(ctx, userToken.Id, *input.ParentId)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting folder: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Parent folder not found", http.StatusNotFound)
+			return
+		}
+
+		// The new parent must not be inside the folder being moved
+		var cycle bool
+		query := `SELECT EXISTS(SELECT 1 FROM (` + folderTreeQuery + `) t WHERE t.id = @parent_id)`
+		args := pgx.NamedArgs{
+			"user_id":   userToken.Id,
+			"folder_id": folderId,
+			"parent_id": *input.ParentId,
+		}
+		if err := tx.QueryRow(ctx, query, args).Scan(&cycle); err != nil {
+			http.Error(w, fmt.Sprintf("Error getting subfolders: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if cycle {
+			http.Error(w, "Can't move a folder into itself or one of its subfolders", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var folder UserFolder
+	err = tx.QueryRow(
+		ctx,
+		"UPDATE folders SET parent_id = $3 WHERE id = $2 AND user_id = $1 RETURNING id, name, parent_id, sort_order",
+		userToken.Id, folderId, input.ParentId,
+	).Scan(&folder.Id, &folder.Name, &folder.ParentId, &folder.SortOrder)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error moving folder: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error moving folder: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(folder)
+}
+
+// Moves subscriptions to a folder, or unfiles them if folder_id is null.
+// Responds with the ids of the subscriptions that were moved.
+func (h *Handler) handleMoveSubscriptions(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Parse the JSON request body
+	var input MoveSubscriptionsInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if len(input.SubscriptionIds) == 0 {
+		http.Error(w, "Missing required field (subscription_ids)", http.StatusBadRequest)
+		return
+	}
+
+	if input.FolderId != nil {
+		exists, err := h.folderExists(context.Background(), userToken.Id, *input.FolderId)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting folder: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	rows, err := h.conn.Query(
+		context.Background(),
+		"UPDATE subscriptions SET folder_id = $3 WHERE id = ANY($2) AND user_id = $1 RETURNING id",
+		userToken.Id, input.SubscriptionIds, input.FolderId,
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error moving subscriptions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	movedIDs, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error scanning moved subscriptions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if movedIDs == nil {
+		movedIDs = []int{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(movedIDs)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+// Folder ids are UUIDs
+const (
+	folder1 = "00000000-0000-0000-0000-000000000001"
+	folder2 = "00000000-0000-0000-0000-000000000002"
+)
+
+func TestHandleDeleteFolderMovesSubscriptions(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectExec("SELECT 1 FROM folders").
+		WithArgs("u1").
+		WillReturnResult(pgxmock.NewResult("SELECT", 2))
+	mockPool.ExpectQuery("SELECT EXISTS").
+		WithArgs(folder1, "u1").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+	mockPool.ExpectQuery("SELECT EXISTS").
+		WithArgs(folder2, "u1").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+	mockPool.ExpectExec("UPDATE subscriptions SET folder_id").
+		WithArgs("u1", folder1, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 3))
+	mockPool.ExpectExec("UPDATE folders SET parent_id").
+		WithArgs("u1", folder1).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	mockPool.ExpectExec("DELETE FROM folders").
+		WithArgs("u1", folder1).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mockPool.ExpectCommit()
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodDelete, "/folders/"+folder1+"?move_to="+folder2, nil)
+	req = mux.SetURLVars(req, map[string]string{"folderId": folder1})
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleDeleteFolder(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Subscriptions moved before a failure are put back
+func TestHandleDeleteFolderRollsBack(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectExec("SELECT 1 FROM folders").
+		WithArgs("u1").
+		WillReturnResult(pgxmock.NewResult("SELECT", 2))
+	mockPool.ExpectQuery("SELECT EXISTS").
+		WithArgs(folder1, "u1").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+	mockPool.ExpectExec("UPDATE subscriptions SET folder_id").
+		WithArgs("u1", folder1, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 3))
+	mockPool.ExpectExec("UPDATE folders SET parent_id").
+		WithArgs("u1", folder1).
+		WillReturnError(errors.New("connection lost"))
+	mockPool.ExpectRollback()
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodDelete, "/folders/"+folder1, nil)
+	req = mux.SetURLVars(req, map[string]string{"folderId": folder1})
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleDeleteFolder(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d; got %d", http.StatusInternalServerError, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Ids that aren't UUIDs, e.g. DELETE /folders/reorder, are not found rather
+// than failing the cast in Postgres
+func TestHandleDeleteFolderInvalidID(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodDelete, "/folders/reorder", nil)
+	req = mux.SetURLVars(req, map[string]string{"folderId": "reorder"})
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleDeleteFolder(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d; got %d", http.StatusNotFound, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleReorderFoldersRejectsUnknownFolders(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	// Only one of the two folders belongs to the user
+	mockPool.ExpectQuery("SELECT COUNT").
+		WithArgs("u1", []string{"f1", "other"}).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(1))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/folders/reorder", strings.NewReader(`{"folder_ids":["f1","other"]}`))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleReorderFolders(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d; got %d", http.StatusBadRequest, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleMoveSubscriptionsUnfiles(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	// A null folder_id skips the folder check
+	mockPool.ExpectQuery("UPDATE subscriptions SET folder_id").
+		WithArgs("u1", []int{1, 2}, (*string)(nil)).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/subscriptions/move", strings.NewReader(`{"subscription_ids":[1,2],"folder_id":null}`))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleMoveSubscriptions(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != "[1,2]" {
+		t.Errorf("Expected moved ids [1,2]; got %s", body)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleMoveSubscriptionsRejectsOtherUsersFolder(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("SELECT EXISTS").
+		WithArgs(folder2, "u1").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(false))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/subscriptions/move", strings.NewReader(`{"subscription_ids":[1],"folder_id":"`+folder2+`"}`))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleMoveSubscriptions(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d; got %d", http.StatusNotFound, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuildFolderTree(t *testing.T) {
+	parent, child := "a", "b"
+	cycleA, cycleB := "x", "y"
+	folders := []UserFolder{
+		{Id: "a", Name: "A", UnreadCount: 1},
+		{Id: "b", Name: "B", ParentId: &parent, UnreadCount: 2},
+		{Id: "c", Name: "C", ParentId: &child, UnreadCount: 3},
+		{Id: "d", Name: "D"},
+		// Parents that form a cycle
+		{Id: "x", Name: "X", ParentId: &cycleB},
+		{Id: "y", Name: "Y", ParentId: &cycleA},
+	}
+
+	tree := buildFolderTree(folders)
+
+	if len(tree) != 3 || tree[0].Id != "a" || tree[1].Id != "d" || tree[2].Id != "x" {
+		t.Fatalf("Unexpected top-level folders: %+v", tree)
+	}
+	if tree[0].UnreadCount != 6 {
+		t.Errorf("Expected unread count to include subfolders; got %d", tree[0].UnreadCount)
+	}
+	if len(tree[0].Children) != 1 || len(tree[0].Children[0].Children) != 1 || tree[0].Children[0].Children[0].Id != "c" {
+		t.Errorf("Unexpected nesting: %+v", tree[0])
+	}
+	if len(tree[2].Children) != 1 || tree[2].Children[0].Id != "y" {
+		t.Errorf("Expected cycle to be listed once: %+v", tree[2])
+	}
+}
+
+func TestHandleMoveFolderRejectsCycle(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectExec("SELECT 1 FROM folders").
+		WithArgs("u1").
+		WillReturnResult(pgxmock.NewResult("SELECT", 2))
+	mockPool.ExpectQuery("SELECT EXISTS").
+		WithArgs(folder2, "u1").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+	// folder2 is a subfolder of folder1
+	mockPool.ExpectQuery("WITH RECURSIVE tree").
+		WithArgs(pgx.NamedArgs{"user_id": "u1", "folder_id": folder1, "parent_id": folder2}).
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+	mockPool.ExpectRollback()
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/folders/"+folder1+"/move", strings.NewReader(`{"parent_id":"`+folder2+`"}`))
+	req = mux.SetURLVars(req, map[string]string{"folderId": folder1})
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleMoveFolder(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d; got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleMoveFolder(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	parent := folder2
+	mockPool.ExpectBegin()
+	mockPool.ExpectExec("SELECT 1 FROM folders").
+		WithArgs("u1").
+		WillReturnResult(pgxmock.NewResult("SELECT", 2))
+	mockPool.ExpectQuery("SELECT EXISTS").
+		WithArgs(folder2, "u1").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+	mockPool.ExpectQuery("WITH RECURSIVE tree").
+		WithArgs(pgx.NamedArgs{"user_id": "u1", "folder_id": folder1, "parent_id": folder2}).
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(false))
+	mockPool.ExpectQuery("UPDATE folders SET parent_id").
+		WithArgs("u1", folder1, &parent).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "name", "parent_id", "sort_order"}).AddRow(folder1, "Tech", &parent, 1))
+	mockPool.ExpectCommit()
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/folders/"+folder1+"/move", strings.NewReader(`{"parent_id":"`+folder2+`"}`))
+	req = mux.SetURLVars(req, map[string]string{"folderId": folder1})
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleMoveFolder(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
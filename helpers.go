@@ -2,13 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"golang.org/x/net/html"
 )
@@ -38,6 +45,100 @@ func getDBPool() (*pgxpool.Pool, error) {
 	return pool, nil
 }
 
+// Reads a duration such as "15m" from the environment, falling back to def if unset or invalid
+func getDurationEnv(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %v", key, value, def)
+		return def
+	}
+
+	return d
+}
+
+// Returns n random bytes as a hex string
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Returns the client's IP address. X-Forwarded-For is only used when
+// TRUST_PROXY_HEADERS is set, i.e. when running behind a trusted proxy.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Reports whether err is a unique violation on a constraint involving column
+func isUniqueViolation(err error, column string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" &&
+		strings.Contains(pgErr.ConstraintName+" "+pgErr.Detail, column)
+}
+
+// Reports whether s is a UUID in the canonical 8-4-4-4-12 form, so ids from
+// the URL can be rejected before Postgres fails to cast them
+func validUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Reads the limit and offset query params, applying defaults and capping the limit
+func getPagination(r *http.Request) (int, int, error) {
+	limit := defaultPageSize
+	offset := 0
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("Invalid limit parameter")
+		}
+		limit = min(n, maxPageSize)
+	}
+
+	if value := r.URL.Query().Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("Invalid offset parameter")
+		}
+		offset = n
+	}
+
+	return limit, offset, nil
+}
+
 // Function to recursively traverse the HTML node tree
 func findFeedLinks(n *html.Node, urls *[]FeedTag) {
 	if n.Type == html.ElementNode && n.Data == "link" {
@@ -72,60 +173,3 @@ func findFeedLinks(n *html.Node, urls *[]FeedTag) {
 		findFeedLinks(c, urls)
 	}
 }
-
-func generateJWT(user User) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"id":       user.Id,
-			"username": user.Username,
-			"email":    user.Email,
-			"exp":      time.Now().Add(time.Hour * 24 * 7).Unix(),
-		})
-
-	secretString := os.Getenv("JWT_SECRET")
-	if secretString == "" {
-		return "", fmt.Errorf("Couldn't get JWT secret path from environment")
-	}
-	secret := []byte(secretString)
-
-	tokenString, err := token.SignedString(secret)
-	if err != nil {
-		return "", err
-	}
-
-	return tokenString, nil
-}
-
-func validateJWT(tokenString string) (*Token, error) {
-	// Parse the token
-	token, err := jwt.ParseWithClaims(tokenString, &Token{}, func(token *jwt.Token) (interface{}, error) {
-		// Get jwt secret from env
-		secretString := os.Getenv("JWT_SECRET")
-		if secretString == "" {
-			return nil, fmt.Errorf("Couldn't get JWT secret path from environment")
-		}
-		secret := []byte(secretString)
-
-		// Ensure the signing method is what we expect
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		return secret, nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	// Get claims from token
-	claims, ok := token.Claims.(*Token)
-	if !ok || !token.Valid {
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	// Get and check expiration
-	if time.Now().Unix() > int64(claims.Exp) {
-		return nil, fmt.Errorf("Token has expired")
-	}
-
-	return claims, nil
-}
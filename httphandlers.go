@@ -3,15 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v5"
-	"github.com/mmcdole/gofeed"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/html"
 )
@@ -32,6 +35,7 @@ type User struct {
 	Username string
 	Email    string
 	Password string
+	Role     string
 }
 
 type FeedTag struct {
@@ -46,33 +50,100 @@ type FeedResponse struct {
 }
 
 type FeedItem struct {
-	Title       string `json:"title"`
-	Content     string `json:"content"`
-	Description string `json:"description"`
+	Id          int       `json:"id"`
+	Title       string    `json:"title"`
+	Link        string    `json:"link"`
+	Author      string    `json:"author"`
+	Published   time.Time `json:"published"`
+	Content     string    `json:"content"`
+	Description string    `json:"description"`
+	Read        bool      `json:"read"`
+	// Set when items from several feeds are listed together
+	Feed *ItemFeed `json:"feed,omitempty"`
+}
+
+// The feed an item belongs to, as the user is subscribed to it
+type ItemFeed struct {
+	Id             int    `json:"id"`
+	SubscriptionId int    `json:"subscription_id"`
+	Title          string `json:"title"`
+	Url            string `json:"url"`
+}
+
+type StarredItem struct {
+	FeedItem
+	StarredAt time.Time `json:"starred_at"`
+}
+
+type StarredItemsResponse struct {
+	Items []StarredItem `json:"items"`
+	Total int           `json:"total"`
 }
 
 type UserFolder struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
+	Id          string       `json:"id"`
+	Name        string       `json:"name"`
+	ParentId    *string      `json:"parent_id"`
+	SortOrder   int          `json:"sort_order"`
+	UnreadCount int          `json:"unread_count"`
+	Children    []UserFolder `json:"children,omitempty"`
 }
 
 type UserSubscription struct {
-	Id          int       `json:"id"`
-	Title       string    `json:"title"`
-	Url         string    `json:"url"`
-	LastChecked time.Time `json:"last_checked"`
+	Id int `json:"id"`
+	// The subscription's own title if it has one, otherwise the feed's
+	Title         string     `json:"title"`
+	FeedTitle     string     `json:"feed_title"`
+	Url           string     `json:"url"`
+	LastChecked   *time.Time `json:"last_checked"`
+	FolderId      *string    `json:"folder_id"`
+	Notify        bool       `json:"notify"`
+	DisplayMode   string     `json:"display_mode"`
+	RetentionDays *int       `json:"retention_days"`
+	UnreadCount   int        `json:"unread_count"`
 }
 
 type Token struct {
-	Id       string `json:"id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Exp      int64  `json:"exp"`
+	Id        string `json:"id"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	Exp       int64  `json:"exp"`
+	Jti       string `json:"jti"`
+	SessionId string `json:"sid"`
+	Role      string `json:"role"`
+	// Set when the request was authenticated with an API key rather than a JWT
+	ApiKeyId string `json:"-"`
 	jwt.MapClaims
 }
 
 type TokenKey string
 
+// Maximum number of stored items returned for a feed
+const feedItemsLimit = 100
+
+// Maximum size of a page read when searching for feed links
+const maxSearchPageBytes = 5 << 20
+
+// Page sizes for paginated listings
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// Counts the items in a subscription's feed that the subscriber hasn't read.
+// Expects the subscription to be aliased as s.
+const unreadCountQuery = `(
+    SELECT COUNT(*) FROM items i
+    WHERE i.feed_id = s.feed_id
+        AND ` + retentionFilter + `
+        AND NOT EXISTS (SELECT 1 FROM item_states st WHERE st.item_id = i.id AND st.user_id = s.user_id AND st.read)
+)`
+
+// Hides items older than the subscription's retention override. The poller
+// only purges items no subscriber keeps, so shorter overrides are applied when
+// reading. Expects items i and subscriptions s.
+const retentionFilter = `(s.retention_days IS NULL OR i.published >= now() - s.retention_days * interval '1 day')`
+
 const (
 	userTokenKey TokenKey = "usertoken"
 )
@@ -80,6 +151,10 @@ const (
 // Sends 200
 func (h *Handler) handleRoot(w http.ResponseWriter, r *http.Request) {}
 
+// Creates an account and emails a verification link. The response is the same
+// whether or not the email is already registered, so registration can't be
+// used to find out which addresses have accounts; the existing owner is emailed
+// instead. New users sign in once registered.
 func (h *Handler) handleRegisterUser(w http.ResponseWriter, r *http.Request) {
 	// Parse the JSON request body
 	var userInput UserInput
@@ -94,75 +169,92 @@ func (h *Handler) handleRegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if a user with the same email already exists
-	var exists bool
-	if err := h.conn.QueryRow(
-		context.Background(),
-		"SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)",
-		userInput.Email,
-	).Scan(&exists); err != nil {
-		http.Error(w, "Error checking for existing user", http.StatusInternalServerError)
-		return
-	}
-	if exists {
-		http.Error(w, "A user with this email already exists", http.StatusConflict)
-		return
-	}
-
-	// Create password hash
+	// Create password hash. This is done for existing emails too, so the
+	// timing of the response doesn't give them away.
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userInput.Password), bcrypt.DefaultCost)
 	if err != nil {
 		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
 		return
 	}
 
-	// Add user row to db
+	// Get the existing user with the same email, if there is one
 	var user User
-	query := `
-        INSERT INTO users (username, email, password)
-        VALUES (@username, @email, @password)
-        RETURNING id, username, email
-    `
-	args := pgx.NamedArgs{
-		"username": userInput.Username,
-		"email":    userInput.Email,
-		"password": hashedPassword,
-	}
-	if err = h.conn.QueryRow(context.Background(), query, args).Scan(&user.Id, &user.Username, &user.Email); err != nil {
-		http.Error(w, fmt.Sprintf("Error adding user to database: %v", err), http.StatusBadRequest)
+	err = h.conn.QueryRow(
+		context.Background(),
+		"SELECT id, username, email FROM users WHERE email = $1",
+		userInput.Email,
+	).Scan(&user.Id, &user.Username, &user.Email)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Error checking for existing user", http.StatusInternalServerError)
 		return
 	}
+	exists := err == nil
 
-	// create JWT
-	tokenString, err := generateJWT(user)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error generating token: %v", err), http.StatusBadRequest)
-		return
+	if !exists {
+		// Add user row to db
+		query := `
+        INSERT INTO users (username, email, password)
+        VALUES (@username, @email, @password)
+        RETURNING id, username, email, role
+        `
+		args := pgx.NamedArgs{
+			"username": userInput.Username,
+			"email":    userInput.Email,
+			"password": hashedPassword,
+		}
+		err = h.conn.QueryRow(context.Background(), query, args).Scan(&user.Id, &user.Username, &user.Email, &user.Role)
+		if isUniqueViolation(err, "email") {
+			// Registered concurrently. The owner will have been sent a
+			// verification email already.
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error adding user to database: %v", err), http.StatusBadRequest)
+			return
+		}
 	}
 
-	// send back token
-	fmt.Fprint(w, tokenString)
+	// Emails are sent in the background so both cases respond alike. New
+	// accounts start unverified, and a failed send can be retried with
+	// /resend-verification.
+	go func(user User) {
+		ctx, cancel := context.WithTimeout(context.Background(), registrationMailTimeout)
+		defer cancel()
+
+		if exists {
+			if err := h.sendRegistrationNotice(ctx, user); err != nil {
+				log.Printf("Error sending registration notice to user %s: %v", user.Id, err)
+			}
+			return
+		}
+		if err := h.sendEmailVerification(ctx, user); err != nil {
+			log.Printf("Error sending verification email to user %s: %v", user.Id, err)
+		}
+	}(user)
+
+	w.WriteHeader(http.StatusAccepted)
 }
 
+// Deletes the signed in user's own account. Admins can delete other users through /admin/users.
 func (h *Handler) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
-	// Get URL for querying
-	id := r.URL.Query().Get("id")
-	if id == "" {
-		http.Error(w, "Missing id parameter", http.StatusBadRequest)
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
 		return
 	}
 
-	if _, err := h.conn.Exec(
-		context.Background(),
-		"DELETE FROM users WHERE id = $1",
-		id,
-	); err != nil {
+	if _, err := h.deleteUser(context.Background(), userToken.Id); err != nil {
 		http.Error(w, "Error deleting user from DB", http.StatusInternalServerError)
-		fmt.Println(err)
 		return
 	}
 }
 
+// Hash of a password nobody uses, checked against when logging in with an
+// unknown email
+const dummyPasswordHash = "$2a$10$ySfaUggkmq056tdIEy8A6evSENnyqnZzf1pBBkRJrlZ/xaYoUFPQa"
+
 func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 	// Parse the JSON request body
 	var userInput UserLoginInput
@@ -171,41 +263,87 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Printf("Logging in %s\n", userInput.Email)
-
 	// Validate required fields
 	if userInput.Email == "" || userInput.Password == "" {
 		http.Error(w, "Missing required fields (email, password)", http.StatusBadRequest)
 		return
 	}
 
+	// Refuse any attempt while the email is locked after repeated failures
+	wait, err := h.loginLockout(context.Background(), userInput.Email)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking login lockout: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+
 	// Get user by email
 	var user User
-	if err := h.conn.QueryRow(
+	var disabled bool
+	err = h.conn.QueryRow(
 		context.Background(),
-		"SELECT id, username, email, password FROM users WHERE email = $1",
+		"SELECT id, username, email, password, role, disabled_at IS NOT NULL FROM users WHERE email = $1",
 		userInput.Email,
-	).Scan(&user.Id, &user.Username, &user.Email, &user.Password); err != nil {
+	).Scan(&user.Id, &user.Username, &user.Email, &user.Password, &user.Role, &disabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Take as long as a wrong password would, so the timing doesn't
+		// reveal that the email isn't registered
+		user.Password = dummyPasswordHash
+	} else if err != nil {
 		http.Error(w, "Error getting user from DB", http.StatusInternalServerError)
-		fmt.Println(err)
 		return
 	}
 
 	// Compare user password input to hashed password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(userInput.Password)); err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(userInput.Password)); err != nil || user.Id == "" {
+		if err := h.recordLoginFailure(context.Background(), userInput.Email); err != nil {
+			log.Printf("Error recording failed login: %v", err)
+		}
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	// create JWT
-	tokenString, err := generateJWT(user)
+	// Only reveal that the account is disabled to someone who knows the password
+	if disabled {
+		http.Error(w, ErrAccountDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Users with 2FA get a challenge to exchange for tokens with a code
+	twoFactor, err := h.totpEnabled(context.Background(), user.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking two-factor authentication: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if twoFactor {
+		challenge, err := h.createLoginChallenge(context.Background(), user.Id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error creating login challenge: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+
+	// Failures are only cleared once the whole login has succeeded
+	if err := h.resetLoginFailures(context.Background(), user.Email); err != nil {
+		log.Printf("Error resetting failed logins for user %s: %v", user.Id, err)
+	}
+
+	// create access and refresh tokens
+	tokens, err := h.issueTokens(context.Background(), user, r)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error generating token: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	// send back token
-	fmt.Fprint(w, tokenString)
+	// send back tokens
+	writeTokenResponse(w, tokens)
 }
 
 func (h *Handler) handleCreateUserFolder(w http.ResponseWriter, r *http.Request) {
@@ -223,14 +361,29 @@ func (h *Handler) handleCreateUserFolder(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Optional parent folder
+	var parentID *string
+	if value := r.URL.Query().Get("parent_id"); value != "" {
+		exists, err := h.folderExists(context.Background(), userToken.Id, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting folder: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Parent folder not found", http.StatusNotFound)
+			return
+		}
+		parentID = &value
+	}
+
 	// Add user row to db
 	var folder UserFolder
 	query := `
-        INSERT INTO folders (user_id, name)
-        VALUES ($1, $2)
-        RETURNING id, name
+        INSERT INTO folders (user_id, name, sort_order, parent_id)
+        VALUES ($1, $2, ` + nextFolderSortOrder + `, $3)
+        RETURNING id, name, parent_id, sort_order
     `
-	if err := h.conn.QueryRow(context.Background(), query, userToken.Id, folderName).Scan(&folder.Id, &folder.Name); err != nil {
+	if err := h.conn.QueryRow(context.Background(), query, userToken.Id, folderName, parentID).Scan(&folder.Id, &folder.Name, &folder.ParentId, &folder.SortOrder); err != nil {
 		http.Error(w, fmt.Sprintf("Error adding folder to database: %v", err), http.StatusBadRequest)
 		return
 	}
@@ -246,12 +399,20 @@ func (h *Handler) handleGetUserFolders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userFolders := []UserFolder{}
-	rows, err := h.conn.Query(
-		context.Background(),
-		"SELECT id, name FROM folders f WHERE user_id = $1",
-		userToken.Id,
-	)
+	var userFolders []UserFolder
+	query := `
+    SELECT f.id, f.name, f.parent_id, f.sort_order, (
+        SELECT COUNT(*) FROM subscriptions s
+        JOIN items i ON i.feed_id = s.feed_id
+        WHERE s.folder_id = f.id
+            AND ` + retentionFilter + `
+            AND NOT EXISTS (SELECT 1 FROM item_states st WHERE st.item_id = i.id AND st.user_id = s.user_id AND st.read)
+    )
+    FROM folders f
+    WHERE f.user_id = $1
+    ORDER BY f.sort_order, f.name
+    `
+	rows, err := h.conn.Query(context.Background(), query, userToken.Id)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error getting folders for user %s: %v", userToken.Id, err), http.StatusInternalServerError)
 		return
@@ -260,7 +421,7 @@ func (h *Handler) handleGetUserFolders(w http.ResponseWriter, r *http.Request) {
 
 	for rows.Next() {
 		var folder UserFolder
-		if err := rows.Scan(&folder.Id, &folder.Name); err != nil {
+		if err := rows.Scan(&folder.Id, &folder.Name, &folder.ParentId, &folder.SortOrder, &folder.UnreadCount); err != nil {
 			http.Error(w, fmt.Sprintf("Error scanning folders row: %v", err), http.StatusInternalServerError)
 			return
 		}
@@ -271,9 +432,7 @@ func (h *Handler) handleGetUserFolders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println("USER FOLDERS: ", userFolders)
-
-	json.NewEncoder(w).Encode(userFolders)
+	json.NewEncoder(w).Encode(buildFolderTree(userFolders))
 }
 
 func (h *Handler) handleGetFolderSubscriptions(w http.ResponseWriter, r *http.Request) {
@@ -286,13 +445,24 @@ func (h *Handler) handleGetFolderSubscriptions(w http.ResponseWriter, r *http.Re
 
 	vars := mux.Vars(r)
 	folderId := vars["folderId"]
+	if !validUUID(folderId) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
 
+	// Includes subscriptions in subfolders
 	var userSubscriptions []UserSubscription
-	rows, err := h.conn.Query(
-		context.Background(),
-		"SELECT s.id, f.title, f.url FROM subscriptions s LEFT JOIN feeds f ON f.id = s.feed_id WHERE user_id = $1 AND folder_id = $2",
-		userToken.Id, folderId,
-	)
+	query := `
+    SELECT ` + subscriptionColumns + `
+    FROM subscriptions s
+    JOIN feeds f ON f.id = s.feed_id
+    WHERE s.user_id = @user_id AND s.folder_id IN (` + folderTreeQuery + `)
+    `
+	args := pgx.NamedArgs{
+		"user_id":   userToken.Id,
+		"folder_id": folderId,
+	}
+	rows, err := h.conn.Query(context.Background(), query, args)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error getting subscriptions for user %s: %v", userToken.Id, err), http.StatusInternalServerError)
 		return
@@ -300,8 +470,8 @@ func (h *Handler) handleGetFolderSubscriptions(w http.ResponseWriter, r *http.Re
 	defer rows.Close()
 
 	for rows.Next() {
-		var sub UserSubscription
-		if err := rows.Scan(&sub.Id, &sub.Title, &sub.Url); err != nil {
+		sub, err := scanSubscription(rows)
+		if err != nil {
 			http.Error(w, fmt.Sprintf("Error scanning subscription row: %v", err), http.StatusInternalServerError)
 			return
 		}
@@ -324,11 +494,13 @@ func (h *Handler) handleGetUserSubscriptions(w http.ResponseWriter, r *http.Requ
 	}
 
 	var userSubscriptions []UserSubscription
-	rows, err := h.conn.Query(
-		context.Background(),
-		"SELECT s.id, f.title, f.url FROM subscriptions s LEFT JOIN feeds f ON f.id = s.feed_id WHERE user_id = $1",
-		userToken.Id,
-	)
+	query := `
+    SELECT ` + subscriptionColumns + `
+    FROM subscriptions s
+    JOIN feeds f ON f.id = s.feed_id
+    WHERE s.user_id = $1
+    `
+	rows, err := h.conn.Query(context.Background(), query, userToken.Id)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error getting subscriptions for user %s: %v", userToken.Id, err), http.StatusInternalServerError)
 		return
@@ -336,8 +508,8 @@ func (h *Handler) handleGetUserSubscriptions(w http.ResponseWriter, r *http.Requ
 	defer rows.Close()
 
 	for rows.Next() {
-		var sub UserSubscription
-		if err := rows.Scan(&sub.Id, &sub.Title, &sub.Url); err != nil {
+		sub, err := scanSubscription(rows)
+		if err != nil {
 			http.Error(w, fmt.Sprintf("Error scanning subscription row: %v", err), http.StatusInternalServerError)
 			return
 		}
@@ -366,8 +538,8 @@ func (h *Handler) handleSearchSubscription(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Make GET request to the URL
-	resp, err := http.Get(parsedURL.String())
+	// Make GET request to the URL, refusing internal addresses
+	resp, err := h.client.Get(parsedURL.String())
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error making GET request to %s: %v", parsedURL, err), http.StatusBadRequest)
 		return
@@ -381,7 +553,7 @@ func (h *Handler) handleSearchSubscription(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Parse html
-	doc, err := html.Parse(resp.Body)
+	doc, err := html.Parse(io.LimitReader(resp.Body, maxSearchPageBytes))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error parsing html response: %v", err), http.StatusInternalServerError)
 		return
@@ -416,23 +588,66 @@ func (h *Handler) handleAddSubscriptions(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Optional folder to file the new subscriptions in
+	var folderID *string
+	if value := r.URL.Query().Get("folder_id"); value != "" {
+		exists, err := h.folderExists(context.Background(), userToken.Id, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting folder: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+		folderID = &value
+	}
+
+	// Unverified users can only have a limited number of subscriptions
+	if err := h.checkSubscriptionLimit(context.Background(), userToken.Id, len(feeds)); err != nil {
+		if errors.Is(err, ErrVerificationRequired) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Check every URL before writing anything
+	for _, feedURL := range feeds {
+		if !validFeedURL(feedURL.Href) {
+			http.Error(w, fmt.Sprintf("Invalid feed URL: %s", feedURL.Href), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The feeds and subscriptions are added together or not at all
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
 	var newFeeds []int
 
+	// Feeds get their title from the feed itself when polled. The title sent
+	// is the subscriber's own, so it is stored on the subscription.
 	addFeedQuery := `
     INSERT INTO feeds (url, title)
-    VALUES (@url, @title)
-    ON CONFLICT (url) DO UPDATE SET title = EXCLUDED.title
+    VALUES (@url, '')
+    ON CONFLICT (url) DO UPDATE SET url = EXCLUDED.url
     RETURNING id
     `
 
 	for _, feedURL := range feeds {
 		args := pgx.NamedArgs{
-			"url":   feedURL.Href,
-			"title": feedURL.Title,
+			"url": feedURL.Href,
 		}
 
 		var feedID int
-		if err := h.conn.QueryRow(context.Background(), addFeedQuery, args).Scan(&feedID); err != nil {
+		if err := tx.QueryRow(ctx, addFeedQuery, args).Scan(&feedID); err != nil {
 			http.Error(w, fmt.Sprintf("Error adding feed to database: %v", err), http.StatusInternalServerError)
 			return
 		}
@@ -444,33 +659,43 @@ func (h *Handler) handleAddSubscriptions(w http.ResponseWriter, r *http.Request)
 	var newSubscriptions []UserSubscription
 
 	addSubscriptionQuery := `
-    WITH inserted_sub AS (
-        INSERT INTO subscriptions (user_id, feed_id)
-        VALUES (@user_id, @feed_id)
-        RETURNING id, user_id, feed_id
+    WITH s AS (
+        INSERT INTO subscriptions (user_id, feed_id, folder_id, title)
+        VALUES (@user_id, @feed_id, @folder_id, NULLIF(@title, ''))
+        RETURNING *
     )
-    SELECT s.id, f.title, f.url, f.last_checked
-    FROM inserted_sub s
+    SELECT ` + subscriptionColumns + `
+    FROM s
     JOIN feeds f ON s.feed_id = f.id
     `
 
-	for _, feedId := range newFeeds {
+	for i, feedId := range newFeeds {
 		args := pgx.NamedArgs{
-			"user_id": userToken.Id,
-			"feed_id": feedId,
+			"user_id":   userToken.Id,
+			"feed_id":   feedId,
+			"folder_id": folderID,
+			"title":     feeds[i].Title,
 		}
-		var returnedSubscription UserSubscription
-		if err := h.conn.QueryRow(
-			context.Background(), addSubscriptionQuery, args,
-		).Scan(
-			&returnedSubscription.Id, &returnedSubscription.Title, &returnedSubscription.Url, &returnedSubscription.LastChecked,
-		); err != nil {
+		returnedSubscription, err := scanSubscription(tx.QueryRow(ctx, addSubscriptionQuery, args))
+		if err != nil {
 			http.Error(w, fmt.Sprintf("Error adding subscription to database: %v", err), http.StatusInternalServerError)
 			return
 		}
 		newSubscriptions = append(newSubscriptions, returnedSubscription)
 	}
 
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error adding subscriptions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch items for the feeds now rather than waiting for the next poll
+	if h.poller != nil {
+		for i, feedID := range newFeeds {
+			h.poller.Enqueue(feedID, feeds[i].Href)
+		}
+	}
+
 	json.NewEncoder(w).Encode(newSubscriptions)
 }
 
@@ -489,26 +714,67 @@ func (h *Handler) handleDeleteSubscriptions(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// The delete, purge and reset happen together or not at all
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
 	// Delete from db
 	query := `
     DELETE FROM subscriptions
     WHERE id = ANY($1)
         AND user_id = $2
-	RETURNING id
+	RETURNING id, feed_id
 	`
 
-	rows, err := h.conn.Query(context.Background(), query, ids, userToken.Id)
+	rows, err := tx.Query(ctx, query, ids, userToken.Id)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error deleting subscriptions: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
 	var deletedIDs []int
-	for rows.Next() {
-		var id int
-		rows.Scan(&id)
+	var feedIDs []int
+	var id, feedID int
+	if _, err := pgx.ForEachRow(rows, []any{&id, &feedID}, func() error {
 		deletedIDs = append(deletedIDs, id)
+		feedIDs = append(feedIDs, feedID)
+		return nil
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting subscriptions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Purge items of feeds nobody subscribes to any more, keeping starred items
+	purgeQuery := `
+    DELETE FROM items i
+    WHERE i.feed_id = ANY($1)
+        AND NOT EXISTS (SELECT 1 FROM subscriptions s WHERE s.feed_id = i.feed_id)
+        AND NOT EXISTS (SELECT 1 FROM starred_items st WHERE st.item_id = i.id)
+    `
+	if _, err := tx.Exec(ctx, purgeQuery, feedIDs); err != nil {
+		http.Error(w, fmt.Sprintf("Error purging items: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Clear validators so a new subscriber gets the full feed again
+	resetQuery := `
+    UPDATE feeds f SET etag = '', last_modified = ''
+    WHERE f.id = ANY($1)
+        AND NOT EXISTS (SELECT 1 FROM subscriptions s WHERE s.feed_id = f.id)
+    `
+	if _, err := tx.Exec(ctx, resetQuery, feedIDs); err != nil {
+		http.Error(w, fmt.Sprintf("Error resetting feeds: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting subscriptions: %v", err), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -516,6 +782,13 @@ func (h *Handler) handleDeleteSubscriptions(w http.ResponseWriter, r *http.Reque
 }
 
 func (h *Handler) handleFetchFeed(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
 	// Get URL for querying
 	href := r.URL.Query().Get("href")
 	if href == "" {
@@ -523,31 +796,313 @@ func (h *Handler) handleFetchFeed(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch feed
-	fp := gofeed.NewParser()
-	feed, err := fp.ParseURL(href)
+	// Get feed from the user's subscriptions
+	var feedID int
+	var feedResponse FeedResponse
+	query := `
+    SELECT f.id, COALESCE(f.title, ''), f.description
+    FROM feeds f
+    JOIN subscriptions s ON s.feed_id = f.id
+    WHERE f.url = $1 AND s.user_id = $2
+    LIMIT 1
+    `
+	if err := h.conn.QueryRow(context.Background(), query, href, userToken.Id).Scan(
+		&feedID, &feedResponse.Title, &feedResponse.Description,
+	); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Feed not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error getting feed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Get stored items with the user's read state, newest first
+	itemsQuery := `
+    SELECT i.id, i.title, i.content, i.description, i.link, i.author, i.published, COALESCE(st.read, false)
+    FROM items i
+    JOIN subscriptions s ON s.feed_id = i.feed_id AND s.user_id = $2
+    LEFT JOIN item_states st ON st.item_id = i.id AND st.user_id = $2
+    WHERE i.feed_id = $1 AND ` + retentionFilter + `
+    ORDER BY i.published DESC, i.id DESC
+    LIMIT $3
+    `
+	rows, err := h.conn.Query(context.Background(), itemsQuery, feedID, userToken.Id, feedItemsLimit)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching feed: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error getting items for feed %d: %v", feedID, err), http.StatusInternalServerError)
 		return
 	}
+	defer rows.Close()
 
-	// Create response
-	var items []FeedItem
-	for _, item := range feed.Items {
-		newItem := FeedItem{
-			Title:       item.Title,
-			Content:     item.Content,
-			Description: item.Description,
+	items := []FeedItem{}
+	for rows.Next() {
+		var item FeedItem
+		if err := rows.Scan(
+			&item.Id, &item.Title, &item.Content, &item.Description, &item.Link, &item.Author, &item.Published, &item.Read,
+		); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning item row: %v", err), http.StatusInternalServerError)
+			return
 		}
-		items = append(items, newItem)
+		item.sanitize(item.Link)
+		items = append(items, item)
 	}
-
-	feedResponse := FeedResponse{
-		Title:       feed.Title,
-		Description: feed.Description,
-		Items:       items,
+	if err := rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating over items: %v", err), http.StatusInternalServerError)
+		return
 	}
+	feedResponse.Items = items
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(feedResponse)
 }
+
+// Sets the read state of the user's items matching condition and returns the ids of the updated items.
+// condition is a SQL expression over items i and subscriptions s, and may use the named args in args.
+func (h *Handler) setItemsRead(ctx context.Context, userID string, read bool, condition string, args pgx.NamedArgs) ([]int, error) {
+	query := `
+    INSERT INTO item_states (user_id, item_id, read, read_at)
+    SELECT DISTINCT s.user_id, i.id, @read::boolean, CASE WHEN @read::boolean THEN now() END
+    FROM items i
+    JOIN subscriptions s ON s.feed_id = i.feed_id
+    WHERE s.user_id = @user_id AND ` + condition + `
+    ON CONFLICT (user_id, item_id) DO UPDATE SET
+        read = EXCLUDED.read,
+        read_at = CASE WHEN item_states.read AND EXCLUDED.read THEN item_states.read_at ELSE EXCLUDED.read_at END
+    RETURNING item_id
+    `
+	args["user_id"] = userID
+	args["read"] = read
+
+	rows, err := h.conn.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[int])
+}
+
+func (h *Handler) handleSetItemRead(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	itemID, err := strconv.Atoi(mux.Vars(r)["itemId"])
+	if err != nil {
+		http.Error(w, "Invalid item id", http.StatusBadRequest)
+		return
+	}
+
+	// POST marks the item read, DELETE marks it unread
+	read := r.Method == http.MethodPost
+
+	updatedIDs, err := h.setItemsRead(
+		context.Background(), userToken.Id, read,
+		"i.id = @item_id", pgx.NamedArgs{"item_id": itemID},
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating item state: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(updatedIDs) == 0 {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+}
+
+func (h *Handler) handleMarkItemsRead(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Item ids from the request
+	var ids []int
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	updatedIDs, err := h.setItemsRead(
+		context.Background(), userToken.Id, true,
+		"i.id = ANY(@ids)", pgx.NamedArgs{"ids": ids},
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating item states: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updatedIDs)
+}
+
+func (h *Handler) handleMarkSubscriptionRead(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	subscriptionID, err := strconv.Atoi(mux.Vars(r)["subscriptionId"])
+	if err != nil {
+		http.Error(w, "Invalid subscription id", http.StatusBadRequest)
+		return
+	}
+
+	updatedIDs, err := h.setItemsRead(
+		context.Background(), userToken.Id, true,
+		"s.id = @subscription_id", pgx.NamedArgs{"subscription_id": subscriptionID},
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating item states: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updatedIDs)
+}
+
+func (h *Handler) handleMarkFolderRead(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	folderId := mux.Vars(r)["folderId"]
+	if !validUUID(folderId) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	updatedIDs, err := h.setItemsRead(
+		context.Background(), userToken.Id, true,
+		"s.folder_id IN ("+folderTreeQuery+")", pgx.NamedArgs{"folder_id": folderId},
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating item states: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updatedIDs)
+}
+
+func (h *Handler) handleStarItem(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	itemID, err := strconv.Atoi(mux.Vars(r)["itemId"])
+	if err != nil {
+		http.Error(w, "Invalid item id", http.StatusBadRequest)
+		return
+	}
+
+	// Only items from the user's subscriptions can be starred
+	query := `
+    INSERT INTO starred_items (user_id, item_id)
+    SELECT DISTINCT s.user_id, i.id
+    FROM items i
+    JOIN subscriptions s ON s.feed_id = i.feed_id
+    WHERE s.user_id = $1 AND i.id = $2
+    ON CONFLICT (user_id, item_id) DO UPDATE SET starred_at = starred_items.starred_at
+    RETURNING item_id
+    `
+	var starredID int
+	if err := h.conn.QueryRow(context.Background(), query, userToken.Id, itemID).Scan(&starredID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Item not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error starring item: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) handleUnstarItem(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	itemID, err := strconv.Atoi(mux.Vars(r)["itemId"])
+	if err != nil {
+		http.Error(w, "Invalid item id", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.conn.Exec(
+		context.Background(),
+		"DELETE FROM starred_items WHERE user_id = $1 AND item_id = $2",
+		userToken.Id, itemID,
+	); err != nil {
+		http.Error(w, fmt.Sprintf("Error unstarring item: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) handleGetStarredItems(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	limit, offset, err := getPagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Starred items are listed whether or not the user is still subscribed to their feed
+	query := `
+    SELECT i.id, i.title, i.content, i.description, i.link, i.author, i.published, COALESCE(st.read, false),
+        si.starred_at, COUNT(*) OVER ()
+    FROM starred_items si
+    JOIN items i ON i.id = si.item_id
+    LEFT JOIN item_states st ON st.item_id = i.id AND st.user_id = si.user_id
+    WHERE si.user_id = $1
+    ORDER BY si.starred_at DESC, i.id DESC
+    LIMIT $2 OFFSET $3
+    `
+	rows, err := h.conn.Query(context.Background(), query, userToken.Id, limit, offset)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting starred items for user %s: %v", userToken.Id, err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	response := StarredItemsResponse{Items: []StarredItem{}}
+	for rows.Next() {
+		var item StarredItem
+		if err := rows.Scan(
+			&item.Id, &item.Title, &item.Content, &item.Description, &item.Link, &item.Author, &item.Published, &item.Read,
+			&item.StarredAt, &response.Total,
+		); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning starred item row: %v", err), http.StatusInternalServerError)
+			return
+		}
+		item.sanitize(item.Link)
+		response.Items = append(response.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating over starred items: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -54,6 +54,28 @@ func TestHandleAddSubscriptions(t *testing.T) {
 	invalidAuthHeader(t, mux, method, path)
 }
 
+func TestHandleMoveSubscriptions(t *testing.T) {
+	method := http.MethodPost
+	path := "/subscriptions/move"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleUpdateSubscription(t *testing.T) {
+	method := http.MethodPut
+	path := "/subscriptions/1"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodPatch, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
 func TestHandleDeleteSubscriptions(t *testing.T) {
 	method := http.MethodDelete
 	path := "/delete-subscriptions"
@@ -64,3 +86,336 @@ func TestHandleDeleteSubscriptions(t *testing.T) {
 	missingAuthHeader(t, mux, method, path)
 	invalidAuthHeader(t, mux, method, path)
 }
+
+func TestHandleFetchFeed(t *testing.T) {
+	method := http.MethodGet
+	path := "/fetch-feed"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodPost, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleGetItems(t *testing.T) {
+	method := http.MethodGet
+	path := "/items"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodPost, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleSetItemRead(t *testing.T) {
+	path := "/items/1/read"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		missingAuthHeader(t, mux, method, path)
+		invalidAuthHeader(t, mux, method, path)
+	}
+}
+
+func TestHandleMarkItemsRead(t *testing.T) {
+	method := http.MethodPost
+	path := "/mark-items-read"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleMarkSubscriptionRead(t *testing.T) {
+	method := http.MethodPost
+	path := "/subscriptions/1/mark-read"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleMarkFolderRead(t *testing.T) {
+	method := http.MethodPost
+	path := "/folders/1/mark-read"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleStarItem(t *testing.T) {
+	path := "/items/1/star"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		missingAuthHeader(t, mux, method, path)
+		invalidAuthHeader(t, mux, method, path)
+	}
+}
+
+func TestHandleGetStarredItems(t *testing.T) {
+	method := http.MethodGet
+	path := "/starred"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodPost, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleImportOPML(t *testing.T) {
+	method := http.MethodPost
+	path := "/import-opml"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleExportOPML(t *testing.T) {
+	method := http.MethodGet
+	path := "/export-opml"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodPost, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleRefreshToken(t *testing.T) {
+	path := "/token/refresh"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	invalidUserInput(t, mux, path)
+}
+
+func TestHandleLogout(t *testing.T) {
+	path := "/logout"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	invalidUserInput(t, mux, path)
+}
+
+func TestHandleSessions(t *testing.T) {
+	path := "/sessions"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodPost, path)
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		missingAuthHeader(t, mux, method, path)
+		invalidAuthHeader(t, mux, method, path)
+	}
+}
+
+func TestHandleRevokeSession(t *testing.T) {
+	method := http.MethodDelete
+	path := "/sessions/1"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleForgotPassword(t *testing.T) {
+	path := "/forgot-password"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+}
+
+func TestHandleResetPassword(t *testing.T) {
+	path := "/reset-password"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	invalidUserInput(t, mux, path)
+}
+
+func TestHandleVerifyEmail(t *testing.T) {
+	path := "/verify-email"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	invalidUserInput(t, mux, path)
+}
+
+func TestHandleResendVerification(t *testing.T) {
+	method := http.MethodPost
+	path := "/resend-verification"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleOIDCLogin(t *testing.T) {
+	path := "/oidc/login"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodPost, path)
+}
+
+func TestHandleOIDCCallback(t *testing.T) {
+	path := "/oidc/callback"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodPost, path)
+}
+
+func TestHandleAPIKeys(t *testing.T) {
+	path := "/api-keys"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodPut, path)
+	missingAuthHeader(t, mux, http.MethodGet, path)
+	invalidAuthHeader(t, mux, http.MethodGet, path)
+	missingAuthHeader(t, mux, http.MethodPost, path)
+	invalidAuthHeader(t, mux, http.MethodPost, path)
+}
+
+func TestHandleRevokeAPIKey(t *testing.T) {
+	method := http.MethodDelete
+	path := "/api-keys/1"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	missingAuthHeader(t, mux, method, path)
+	invalidAuthHeader(t, mux, method, path)
+}
+
+func TestHandleLoginTwoFactor(t *testing.T) {
+	path := "/login/2fa"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodGet, path)
+	invalidUserInput(t, mux, path)
+}
+
+func TestHandleTwoFactorSettings(t *testing.T) {
+	method := http.MethodPost
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	for _, path := range []string{"/2fa/enroll", "/2fa/confirm", "/2fa/disable", "/2fa/recovery-codes"} {
+		invalidMethod(t, mux, http.MethodGet, path)
+		missingAuthHeader(t, mux, method, path)
+		invalidAuthHeader(t, mux, method, path)
+	}
+}
+
+func TestHandleJWKS(t *testing.T) {
+	path := "/.well-known/jwks.json"
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	invalidMethod(t, mux, http.MethodPost, path)
+}
+
+func TestHandleAdminUsers(t *testing.T) {
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/admin/users"},
+		{http.MethodPost, "/admin/users/1/disable"},
+		{http.MethodPost, "/admin/users/1/enable"},
+		{http.MethodPost, "/admin/users/1/force-password-reset"},
+		{http.MethodDelete, "/admin/users/1"},
+	}
+
+	for _, tt := range tests {
+		missingAuthHeader(t, mux, tt.method, tt.path)
+		invalidAuthHeader(t, mux, tt.method, tt.path)
+	}
+	invalidMethod(t, mux, http.MethodGet, "/admin/users/1/disable")
+}
+
+func TestHandleAccountSettings(t *testing.T) {
+	method := http.MethodPost
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	for _, path := range []string{"/account/password", "/account/email", "/account/username"} {
+		invalidMethod(t, mux, http.MethodGet, path)
+		missingAuthHeader(t, mux, method, path)
+		invalidAuthHeader(t, mux, method, path)
+	}
+}
+
+func TestHandleDataExport(t *testing.T) {
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/account/export"},
+		{http.MethodGet, "/account/export/1"},
+		{http.MethodGet, "/account/export/1/download"},
+	}
+
+	for _, tt := range tests {
+		missingAuthHeader(t, mux, tt.method, tt.path)
+		invalidAuthHeader(t, mux, tt.method, tt.path)
+	}
+	invalidMethod(t, mux, http.MethodGet, "/account/export")
+}
+
+func TestHandleFolders(t *testing.T) {
+	handler := setupTestHandler(t)
+	mux := SetupRouter(handler)
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPut, "/folders/1"},
+		{http.MethodDelete, "/folders/1"},
+		{http.MethodPost, "/folders/reorder"},
+		{http.MethodPost, "/folders/1/move"},
+	}
+
+	for _, tt := range tests {
+		missingAuthHeader(t, mux, tt.method, tt.path)
+		invalidAuthHeader(t, mux, tt.method, tt.path)
+	}
+	invalidMethod(t, mux, http.MethodGet, "/folders/reorder")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	itemOrderNewest = "newest"
+	itemOrderOldest = "oldest"
+)
+
+type ItemsResponse struct {
+	Items []FeedItem `json:"items"`
+	// Pass as the cursor param to get the next page. Null on the last page.
+	NextCursor *string `json:"next_cursor"`
+}
+
+// Position of the last item on a page, in the order items are listed
+type itemCursor struct {
+	Published time.Time `json:"p"`
+	Id        int       `json:"i"`
+}
+
+func encodeItemCursor(item FeedItem) string {
+	data, _ := json.Marshal(itemCursor{Published: item.Published, Id: item.Id})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeItemCursor(value string) (itemCursor, error) {
+	var cursor itemCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
+
+// Builds the WHERE conditions and args for the /items filters in the query params
+func itemFilters(r *http.Request, userID string) ([]string, pgx.NamedArgs, error) {
+	query := r.URL.Query()
+	conditions := []string{"s.user_id = @user_id", retentionFilter}
+	args := pgx.NamedArgs{"user_id": userID}
+
+	if value := query.Get("subscription_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid subscription_id parameter")
+		}
+		conditions = append(conditions, "s.id = @subscription_id")
+		args["subscription_id"] = id
+	}
+
+	// Includes items in subfolders
+	if value := query.Get("folder_id"); value != "" {
+		if !validUUID(value) {
+			return nil, nil, fmt.Errorf("Invalid folder_id parameter")
+		}
+		conditions = append(conditions, "s.folder_id IN ("+folderTreeQuery+")")
+		args["folder_id"] = value
+	}
+
+	if value := query.Get("unread"); value != "" {
+		unread, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid unread parameter")
+		}
+		if unread {
+			conditions = append(conditions, "NOT COALESCE(st.read, false)")
+		}
+	}
+
+	if value := query.Get("starred"); value != "" {
+		starred, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid starred parameter")
+		}
+		if starred {
+			conditions = append(conditions, "EXISTS (SELECT 1 FROM starred_items si WHERE si.item_id = i.id AND si.user_id = s.user_id)")
+		}
+	}
+
+	if value := query.Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid since parameter (must be RFC 3339)")
+		}
+		conditions = append(conditions, "i.published >= @since")
+		args["since"] = since
+	}
+
+	if value := query.Get("until"); value != "" {
+		until, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid until parameter (must be RFC 3339)")
+		}
+		conditions = append(conditions, "i.published < @until")
+		args["until"] = until
+	}
+
+	return conditions, args, nil
+}
+
+// Lists items across the user's subscriptions, newest first unless order=oldest.
+// Pages are keyed on (published, id), so items arriving between requests don't
+// shift later pages.
+func (h *Handler) handleGetItems(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	conditions, args, err := itemFilters(r, userToken.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, _, err := getPagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	order := r.URL.Query().Get("order")
+	if order == "" {
+		order = itemOrderNewest
+	}
+	if order != itemOrderNewest && order != itemOrderOldest {
+		http.Error(w, fmt.Sprintf("Invalid order parameter (must be %s or %s)", itemOrderNewest, itemOrderOldest), http.StatusBadRequest)
+		return
+	}
+	direction, comparison := "DESC", "<"
+	if order == itemOrderOldest {
+		direction, comparison = "ASC", ">"
+	}
+
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := decodeItemCursor(value)
+		if err != nil {
+			http.Error(w, "Invalid cursor parameter", http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, "(i.published, i.id) "+comparison+" (@cursor_published, @cursor_id)")
+		args["cursor_published"] = cursor.Published
+		args["cursor_id"] = cursor.Id
+	}
+
+	// One extra row shows whether there's a next page
+	query := `
+    SELECT i.id, i.title, i.content, i.description, i.link, i.author, i.published, COALESCE(st.read, false),
+        f.id, s.id, COALESCE(s.title, f.title, ''), f.url
+    FROM items i
+    JOIN subscriptions s ON s.feed_id = i.feed_id
+    JOIN feeds f ON f.id = i.feed_id
+    LEFT JOIN item_states st ON st.item_id = i.id AND st.user_id = s.user_id
+    WHERE ` + strings.Join(conditions, " AND ") + `
+    ORDER BY i.published ` + direction + `, i.id ` + direction + `
+    LIMIT @limit
+    `
+	args["limit"] = limit + 1
+
+	rows, err := h.conn.Query(context.Background(), query, args)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting items for user %s: %v", userToken.Id, err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	response := ItemsResponse{Items: []FeedItem{}}
+	for rows.Next() {
+		item := FeedItem{Feed: &ItemFeed{}}
+		if err := rows.Scan(
+			&item.Id, &item.Title, &item.Content, &item.Description, &item.Link, &item.Author, &item.Published, &item.Read,
+			&item.Feed.Id, &item.Feed.SubscriptionId, &item.Feed.Title, &item.Feed.Url,
+		); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning item row: %v", err), http.StatusInternalServerError)
+			return
+		}
+		item.sanitize(item.Link)
+		response.Items = append(response.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating over items: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if len(response.Items) > limit {
+		response.Items = response.Items[:limit]
+		cursor := encodeItemCursor(response.Items[limit-1])
+		response.NextCursor = &cursor
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestItemCursorRoundTrip(t *testing.T) {
+	published := time.Date(2024, 5, 1, 12, 30, 0, 123456000, time.UTC)
+	cursor, err := decodeItemCursor(encodeItemCursor(FeedItem{Id: 42, Published: published}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cursor.Id != 42 || !cursor.Published.Equal(published) {
+		t.Errorf("Unexpected cursor: %+v", cursor)
+	}
+
+	if _, err := decodeItemCursor("not a cursor"); err == nil {
+		t.Error("Expected an error for an invalid cursor")
+	}
+}
+
+func TestHandleGetItemsPaginates(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	newer := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	older := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	columns := []string{
+		"id", "title", "content", "description", "link", "author", "published", "read",
+		"feed_id", "subscription_id", "feed_title", "url",
+	}
+
+	// A limit of 2 fetches 3 rows to see that there's another page. Items past
+	// the subscription's retention are left out.
+	mockPool.ExpectQuery(`s.retention_days IS NULL(.+)NOT COALESCE\(st.read, false\)(.+)ORDER BY i.published DESC, i.id DESC`).
+		WithArgs("u1", 3).
+		WillReturnRows(pgxmock.NewRows(columns).
+			AddRow(3, "Three", "", "", "https://example.com/3", "", newer, false, 1, 10, "Example", "https://example.com/feed.xml").
+			AddRow(2, "Two", "", "", "https://example.com/2", "", older, false, 1, 10, "Example", "https://example.com/feed.xml").
+			AddRow(1, "One", "", "", "https://example.com/1", "", older, false, 1, 10, "Example", "https://example.com/feed.xml"))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodGet, "/items?unread=true&limit=2", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleGetItems(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var response ItemsResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if len(response.Items) != 2 || response.Items[0].Feed == nil || response.Items[0].Feed.SubscriptionId != 10 {
+		t.Fatalf("Unexpected items: %+v", response.Items)
+	}
+	if response.NextCursor == nil {
+		t.Fatal("Expected a next cursor")
+	}
+
+	cursor, err := decodeItemCursor(*response.NextCursor)
+	if err != nil || cursor.Id != 2 || !cursor.Published.Equal(older) {
+		t.Errorf("Expected cursor at the last item on the page; got %+v (%v)", cursor, err)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleGetItemsValidation(t *testing.T) {
+	tests := []string{
+		"/items?order=random",
+		"/items?unread=maybe",
+		"/items?since=yesterday",
+		"/items?subscription_id=abc",
+		"/items?folder_id=abc",
+		"/items?cursor=!!!",
+	}
+
+	for _, path := range tests {
+		handler := &Handler{}
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+		w := httptest.NewRecorder()
+		handler.handleGetItems(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for %s; got %d", http.StatusBadRequest, path, w.Code)
+		}
+	}
+}
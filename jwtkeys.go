@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// A key access tokens are signed or verified with. Keys loaded from a public key
+// file can only verify.
+type jwtKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// The key new access tokens are signed with, plus older keys that are still
+// accepted so rotating the signing key doesn't log everyone out. Loaded once at
+// startup.
+type KeySet struct {
+	signing *jwtKey
+	// By kid. The HS256 secret has no kid, matching tokens issued before key ids.
+	keys map[string]*jwtKey
+}
+
+// Loads the key set from the environment:
+//
+//	JWT_SIGNING_KEY_FILE   PEM RSA or Ed25519 private key new tokens are signed with
+//	JWT_VERIFY_KEY_FILES   comma-separated PEM keys that are still accepted, e.g. the previous signing key
+//	JWT_SECRET             HS256 secret, used for signing if there is no signing key file
+//	                       and otherwise only accepted for verification
+func loadKeySet() (*KeySet, error) {
+	keys := &KeySet{keys: map[string]*jwtKey{}}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		keys.signing = keys.add(hmacKey(secret))
+	}
+
+	if path := os.Getenv("JWT_SIGNING_KEY_FILE"); path != "" {
+		key, err := loadJWTKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load JWT_SIGNING_KEY_FILE: %v", err)
+		}
+		if key.signKey == nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEY_FILE must contain a private key")
+		}
+		keys.signing = keys.add(key)
+	}
+
+	for _, path := range splitList(os.Getenv("JWT_VERIFY_KEY_FILES")) {
+		key, err := loadJWTKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load JWT verification key %s: %v", path, err)
+		}
+		keys.add(key)
+	}
+
+	if keys.signing == nil {
+		return nil, fmt.Errorf("Couldn't get JWT_SECRET or JWT_SIGNING_KEY_FILE from environment")
+	}
+
+	return keys, nil
+}
+
+// Creates a key set that signs and verifies with a single HS256 secret
+func newHMACKeySet(secret string) *KeySet {
+	keys := &KeySet{keys: map[string]*jwtKey{}}
+	keys.signing = keys.add(hmacKey(secret))
+	return keys
+}
+
+func (k *KeySet) add(key *jwtKey) *jwtKey {
+	k.keys[key.id] = key
+	return key
+}
+
+func hmacKey(secret string) *jwtKey {
+	return &jwtKey{method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)}
+}
+
+// Reads a PEM private or public key. The kid is derived from the public key, so
+// the same key gets the same kid whichever file it is loaded from.
+func loadJWTKeyFile(path string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &jwtKey{}
+	switch parsed := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.method, key.signKey, key.verifyKey = jwt.SigningMethodRS256, parsed, &parsed.PublicKey
+	case *rsa.PublicKey:
+		key.method, key.verifyKey = jwt.SigningMethodRS256, parsed
+	case ed25519.PrivateKey:
+		key.method, key.signKey, key.verifyKey = jwt.SigningMethodEdDSA, parsed, parsed.Public()
+	case ed25519.PublicKey:
+		key.method, key.verifyKey = jwt.SigningMethodEdDSA, parsed
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, expected RSA or Ed25519", parsed)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.verifyKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	key.id = base64.RawURLEncoding.EncodeToString(sum[:12])
+
+	return key, nil
+}
+
+func (k *KeySet) generateJWT(user User, sessionID string) (string, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(k.signing.method,
+		jwt.MapClaims{
+			"id":       user.Id,
+			"username": user.Username,
+			"email":    user.Email,
+			"exp":      time.Now().Add(getAccessTokenTTL()).Unix(),
+			"jti":      jti,
+			"sid":      sessionID,
+			"role":     user.Role,
+		})
+	if k.signing.id != "" {
+		token.Header["kid"] = k.signing.id
+	}
+
+	tokenString, err := token.SignedString(k.signing.signKey)
+	if err != nil {
+		return "", err
+	}
+
+	return tokenString, nil
+}
+
+func (k *KeySet) validateJWT(tokenString string) (*Token, error) {
+	// Parse the token
+	token, err := jwt.ParseWithClaims(tokenString, &Token{}, func(token *jwt.Token) (interface{}, error) {
+		// Find the key by kid. Tokens without one were signed with the HS256 secret.
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("Unknown signing key: %q", kid)
+		}
+
+		// Ensure the signing method is the key's, so a public key can't be used as an HMAC secret
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.verifyKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Get claims from token
+	claims, ok := token.Claims.(*Token)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	// Get and check expiration
+	if time.Now().Unix() > int64(claims.Exp) {
+		return nil, fmt.Errorf("Token has expired")
+	}
+
+	return claims, nil
+}
+
+// Public keys for verifying access tokens, in JWKS format. HS256 secrets are never included.
+func (k *KeySet) jwks() jsonWebKeySet {
+	set := jsonWebKeySet{Keys: []jsonWebKey{}}
+	for _, key := range k.keys {
+		jwk := jsonWebKey{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+func (h *Handler) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.keys.jwks())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKeySetRotation(t *testing.T) {
+	user := User{Id: "u1", Username: "user", Email: "test@email.com"}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPath := writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPath := writePEM(t, "PRIVATE KEY", edDER)
+
+	// Tokens from before asymmetric keys were used
+	legacyToken, err := newHMACKeySet("test-secret").generateJWT(user, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign with RSA, still accepting the HS256 secret
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("JWT_SIGNING_KEY_FILE", rsaPath)
+	oldKeys, err := loadKeySet()
+	if err != nil {
+		t.Fatalf("Error loading keys: %v", err)
+	}
+	rsaToken, err := oldKeys.generateJWT(user, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate to Ed25519, keeping the RSA key for verification only
+	rsaPubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_SIGNING_KEY_FILE", edPath)
+	t.Setenv("JWT_VERIFY_KEY_FILES", writePEM(t, "PUBLIC KEY", rsaPubDER))
+	keys, err := loadKeySet()
+	if err != nil {
+		t.Fatalf("Error loading keys: %v", err)
+	}
+	edToken, err := keys.generateJWT(user, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := oldKeys.validateJWT(legacyToken); err != nil {
+		t.Errorf("Expected HS256 token to be accepted alongside RSA key: %v", err)
+	}
+	for name, token := range map[string]string{"RSA": rsaToken, "Ed25519": edToken} {
+		claims, err := keys.validateJWT(token)
+		if err != nil {
+			t.Errorf("Expected %s token to be valid after rotation: %v", name, err)
+			continue
+		}
+		if claims.Id != "u1" || claims.SessionId != "s1" {
+			t.Errorf("Unexpected claims %+v", claims)
+		}
+	}
+	if _, err := keys.validateJWT(legacyToken); err == nil {
+		t.Error("Expected HS256 token to be rejected once the secret is removed")
+	}
+
+	jwks := keys.jwks()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("Expected 2 public keys; got %d", len(jwks.Keys))
+	}
+	for _, jwk := range jwks.Keys {
+		if _, ok := keys.keys[jwk.Kid]; !ok || jwk.Kid == "" {
+			t.Errorf("Unexpected kid %q", jwk.Kid)
+		}
+	}
+}
+
+// A token signed with HS256 using the RSA public key as the secret must not verify
+func TestKeySetRejectsAlgorithmConfusion(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_SIGNING_KEY_FILE", writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)))
+	t.Setenv("JWT_SECRET", "")
+	keys, err := loadKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": "u1", "exp": 9999999999})
+	token.Header["kid"] = keys.signing.id
+	forged, err := token.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := keys.validateJWT(forged); err == nil {
+		t.Error("Expected forged HS256 token to be rejected")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends transactional email such as password resets
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+// Creates the mailer selected by MAILER, which must be set:
+//
+//	log   prints messages, including reset and verification links, to stdout. For development only.
+//	file  writes each message to a .eml file in MAIL_DIR
+//	smtp  sends through SMTP_HOST:SMTP_PORT, authenticating with SMTP_USERNAME/SMTP_PASSWORD if set
+func newMailerFromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	switch os.Getenv("MAILER") {
+	case "":
+		return nil, fmt.Errorf("MAILER is required (smtp, file, or log for development)")
+
+	case "log":
+		log.Printf("MAILER=log prints password reset and verification links to stdout; don't use it in production")
+		return &logMailer{from: from}, nil
+
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("MAIL_DIR is required for the file mailer")
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("Couldn't create MAIL_DIR: %v", err)
+		}
+		return &fileMailer{from: from, dir: dir}, nil
+
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		port := os.Getenv("SMTP_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("SMTP_HOST and SMTP_PORT are required for the smtp mailer")
+		}
+
+		var auth smtp.Auth
+		if username := os.Getenv("SMTP_USERNAME"); username != "" {
+			auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		return &smtpMailer{from: from, addr: net.JoinHostPort(host, port), auth: auth}, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown MAILER %q", os.Getenv("MAILER"))
+	}
+}
+
+// Strips line breaks from header values so they can't inject headers
+var headerReplacer = strings.NewReplacer("\r", "", "\n", "")
+
+// Formats a plain text message with the headers needed to send or store it
+func formatMail(from string, mail Mail) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", headerReplacer.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerReplacer.Replace(mail.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerReplacer.Replace(mail.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Prints messages to stdout, for local development
+type logMailer struct {
+	from string
+}
+
+func (m *logMailer) Send(ctx context.Context, mail Mail) error {
+	fmt.Printf("----- MAIL -----\n%s\n----------------\n", formatMail(m.from, mail))
+	return nil
+}
+
+// Writes each message to a file, for local development and tests
+type fileMailer struct {
+	from string
+	dir  string
+}
+
+func (m *fileMailer) Send(ctx context.Context, mail Mail) error {
+	suffix, err := randomHex(4)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), suffix)
+	return os.WriteFile(filepath.Join(m.dir, name), formatMail(m.from, mail), 0o644)
+}
+
+type smtpMailer struct {
+	from string
+	addr string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(ctx context.Context, mail Mail) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{mail.To}, formatMail(m.from, mail))
+}
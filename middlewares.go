@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -11,7 +12,7 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		// Handle preflight request
@@ -24,8 +25,9 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
-// Middleware to print the Authorization header
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// Middleware to validate the Bearer token and check that its session hasn't been
+// revoked. API keys are accepted in place of a JWT if their scopes allow the method.
+func (h *Handler) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Get the Authorization header
 		authHeader := r.Header.Get("Authorization")
@@ -36,12 +38,34 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
-		token, err := validateJWT(tokenString)
+		if strings.HasPrefix(tokenString, apiKeyPrefix) {
+			token, err := h.authenticateAPIKey(r.Context(), tokenString, r.Method)
+			if errors.Is(err, ErrInsufficientScope) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error validating API key: %v", err), http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), userTokenKey, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		token, err := h.keys.validateJWT(tokenString)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error validating JWT: %v", err), http.StatusUnauthorized)
 			return
 		}
 
+		// Check the session is still active and record activity
+		if err := h.touchSession(r.Context(), token, clientIP(r)); err != nil {
+			http.Error(w, fmt.Sprintf("Error validating session: %v", err), http.StatusUnauthorized)
+			return
+		}
+
 		// Context to hold token
 		ctx := context.WithValue(r.Context(), userTokenKey, token)
 
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestAuthMiddlewareRejectsRevokedSession(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	keys := newHMACKeySet("test-secret")
+	tokenString, err := keys.generateJWT(User{Id: "u1", Username: "user", Email: "test@email.com"}, "s1")
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	// No active session matches
+	mockPool.ExpectQuery("WITH active AS").
+		WithArgs("s1", "u1", pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(false))
+
+	handler := &Handler{conn: mockPool, keys: keys}
+	called := false
+	next := handler.authMiddleware(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	req := httptest.NewRequest(http.MethodGet, "/user-subscriptions", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	w := httptest.NewRecorder()
+	next.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d; got %d", http.StatusUnauthorized, w.Code)
+	}
+	if called {
+		t.Error("Expected the next handler not to be called")
+	}
+}
+
+func TestAuthMiddlewareAcceptsActiveSession(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	keys := newHMACKeySet("test-secret")
+	tokenString, err := keys.generateJWT(User{Id: "u1", Username: "user", Email: "test@email.com"}, "s1")
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	mockPool.ExpectQuery("WITH active AS").
+		WithArgs("s1", "u1", pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+
+	handler := &Handler{conn: mockPool, keys: keys}
+	var token *Token
+	next := handler.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		token, _ = r.Context().Value(userTokenKey).(*Token)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/user-subscriptions", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	w := httptest.NewRecorder()
+	next.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if token == nil || token.Id != "u1" || token.SessionId != "s1" || token.Jti == "" {
+		t.Errorf("Unexpected token in context: %+v", token)
+	}
+}
@@ -0,0 +1,4 @@
+-- Validators from the last feed response, sent back as If-None-Match / If-Modified-Since
+
+ALTER TABLE feeds ADD COLUMN IF NOT EXISTS etag TEXT NOT NULL DEFAULT '';
+ALTER TABLE feeds ADD COLUMN IF NOT EXISTS last_modified TEXT NOT NULL DEFAULT '';
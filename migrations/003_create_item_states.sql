@@ -0,0 +1,9 @@
+-- Per-user read state of feed items. Items without a row are unread.
+
+CREATE TABLE IF NOT EXISTS item_states (
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    item_id BIGINT NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+    read BOOLEAN NOT NULL DEFAULT false,
+    read_at TIMESTAMPTZ,
+    PRIMARY KEY (user_id, item_id)
+);
@@ -0,0 +1,10 @@
+-- Items starred by a user. Starred items are never purged.
+
+CREATE TABLE IF NOT EXISTS starred_items (
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    item_id BIGINT NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+    starred_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, item_id)
+);
+
+CREATE INDEX IF NOT EXISTS starred_items_user_starred_at_idx ON starred_items (user_id, starred_at DESC);
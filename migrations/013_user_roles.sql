@@ -0,0 +1,6 @@
+-- User roles and disabled accounts. Promote an admin with:
+--   UPDATE users SET role = 'admin' WHERE email = '...';
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'
+    CHECK (role IN ('user', 'admin'));
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ;
@@ -0,0 +1,11 @@
+-- Persisted folder order. Existing folders are ordered by name.
+
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS sort_order INT NOT NULL DEFAULT 0;
+
+UPDATE folders f
+SET sort_order = o.position
+FROM (
+    SELECT id, row_number() OVER (PARTITION BY user_id ORDER BY name, id) AS position
+    FROM folders
+) o
+WHERE f.id = o.id AND f.sort_order = 0;
@@ -0,0 +1,7 @@
+-- Nested folders. Top-level folders have no parent. handleDeleteFolder moves a
+-- deleted folder's subfolders up to its own parent before deleting it, so
+-- ON DELETE SET NULL only applies to folders removed some other way.
+
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS parent_id UUID REFERENCES folders (id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS folders_parent_id_idx ON folders (parent_id);
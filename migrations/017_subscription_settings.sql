@@ -0,0 +1,8 @@
+-- Per-subscription display title and settings. A null title shows the feed's
+-- own title, and a null retention_days uses ITEM_RETENTION.
+
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS title TEXT;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS notify BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS display_mode TEXT NOT NULL DEFAULT 'full'
+    CHECK (display_mode IN ('full', 'summary', 'title'));
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS retention_days INT CHECK (retention_days > 0);
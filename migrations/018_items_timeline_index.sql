@@ -0,0 +1,6 @@
+-- Keyset pagination for GET /items orders by (published, id). This replaces
+-- items_feed_published_idx, which it covers.
+
+CREATE INDEX IF NOT EXISTS items_feed_published_id_idx ON items (feed_id, published DESC, id DESC);
+
+DROP INDEX IF EXISTS items_feed_published_idx;
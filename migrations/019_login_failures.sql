@@ -0,0 +1,10 @@
+-- Lockout after repeated failed logins. Failures are counted per email rather
+-- than per account, so addresses with no account lock out the same way
+-- registered ones do.
+
+CREATE TABLE IF NOT EXISTS login_failures (
+    email TEXT PRIMARY KEY,
+    failed_logins INT NOT NULL DEFAULT 0,
+    locked_until TIMESTAMPTZ,
+    last_failed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,6 @@
+-- Accounts created through an identity provider get a random password nobody
+-- knows, so they may set one without giving the current one, as long as they
+-- have just signed in through the provider. Existing accounts keep needing it;
+-- their owners can reset it by email instead.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS has_password BOOLEAN NOT NULL DEFAULT true;
@@ -0,0 +1,15 @@
+-- At most one export in progress per user. Any duplicates left by concurrent
+-- requests are failed first so the index can be built.
+
+UPDATE data_exports d
+SET status = 'failed', error = 'Export was interrupted, please try again', completed_at = now()
+WHERE d.status IN ('pending', 'running')
+    AND EXISTS (
+        SELECT 1 FROM data_exports o
+        WHERE o.user_id = d.user_id
+            AND o.status IN ('pending', 'running')
+            AND (o.created_at, o.id) > (d.created_at, d.id)
+    );
+
+CREATE UNIQUE INDEX IF NOT EXISTS data_exports_in_progress_idx ON data_exports (user_id)
+WHERE status IN ('pending', 'running');
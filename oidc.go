@@ -0,0 +1,783 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	oidcStateTTL     = 10 * time.Minute
+	oidcHTTPTimeout  = 10 * time.Second
+	oidcMaxBodySize  = 1 << 20
+	oidcJWKSCacheTTL = time.Hour
+	// Holds the state on the browser that started the login
+	oidcStateCookie = "oidc_state"
+	// Tries at finding a free username for a new user before giving up
+	oidcUsernameAttempts = 5
+	// How often expired states of abandoned logins are deleted
+	oidcStateSweepEvery = 10 * time.Minute
+)
+
+var (
+	ErrOIDCNotConfigured = errors.New("OIDC login is not configured")
+	ErrInvalidIDToken    = errors.New("invalid ID token")
+	ErrEmailNotVerified  = errors.New("an account with this email exists and the identity provider hasn't verified the email")
+)
+
+// Signing algorithms accepted for ID tokens
+var oidcSigningMethods = map[string]bool{
+	"RS256": true,
+	"RS384": true,
+	"RS512": true,
+	"ES256": true,
+	"ES384": true,
+	"ES512": true,
+}
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// Frontend URL to redirect to after login with tokens in the fragment. If
+	// empty the callback responds with the tokens as JSON.
+	PostLoginRedirect string
+}
+
+// Reads the OIDC config from the environment. Returns nil if OIDC_ISSUER isn't set.
+func loadOIDCConfig() (*OIDCConfig, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	config := &OIDCConfig{
+		Issuer:            strings.TrimSuffix(issuer, "/"),
+		ClientID:          os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:      os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:       os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:            strings.Fields(os.Getenv("OIDC_SCOPES")),
+		PostLoginRedirect: os.Getenv("OIDC_POST_LOGIN_REDIRECT"),
+	}
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required when OIDC_ISSUER is set")
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	return config, nil
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	IDToken string `json:"id_token"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// Identity asserted by a validated ID token
+type OIDCIdentity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// Client for a single OpenID Connect provider. Discovery and keys are fetched
+// lazily and cached.
+type OIDCProvider struct {
+	config OIDCConfig
+	// The provider is configured by the operator rather than users, so this is
+	// a plain client that may reach internal identity providers
+	client *http.Client
+
+	mu          sync.Mutex
+	metadata    *oidcMetadata
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+func NewOIDCProvider(config OIDCConfig, client *http.Client) *OIDCProvider {
+	if client == nil {
+		client = &http.Client{Timeout: oidcHTTPTimeout}
+	}
+	return &OIDCProvider{config: config, client: client}
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, rawURL string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received %d response from %s", resp.StatusCode, rawURL)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxBodySize)).Decode(v)
+}
+
+// Fetches and caches the provider's discovery document
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var metadata oidcMetadata
+	if err := p.getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, fmt.Errorf("error fetching OIDC discovery document: %w", err)
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("OIDC discovery issuer %q doesn't match %q", metadata.Issuer, p.config.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document is missing endpoints")
+	}
+
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// Returns the provider's signing key with the given id, refetching the key set
+// if the id is unknown or the cache is stale
+func (p *OIDCProvider) signingKey(ctx context.Context, kid string) (interface{}, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok && time.Since(p.keysFetched) < oidcJWKSCacheTTL {
+		return key, nil
+	}
+
+	var set jsonWebKeySet
+	if err := p.getJSON(ctx, metadata.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("error fetching OIDC keys: %w", err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidIDToken, kid)
+	}
+	return key, nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// Derives the S256 PKCE challenge for a code verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Builds the authorization request URL for the authorization code flow with PKCE
+func (p *OIDCProvider) authCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	params := authURL.Query()
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("scope", strings.Join(p.config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", pkceChallenge(verifier))
+	params.Set("code_challenge_method", "S256")
+	authURL.RawQuery = params.Encode()
+
+	return authURL.String(), nil
+}
+
+// Exchanges an authorization code for the provider's ID token
+func (p *OIDCProvider) exchangeCode(ctx context.Context, code string, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error exchanging code: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, body)
+	}
+
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxBodySize)).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("error decoding token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("token response has no id_token")
+	}
+
+	return tokens.IDToken, nil
+}
+
+// Validates an ID token's signature, issuer, audience, expiry and nonce
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, rawIDToken string, nonce string) (*OIDCIdentity, error) {
+	token, err := jwt.Parse(rawIDToken, func(token *jwt.Token) (interface{}, error) {
+		alg, _ := token.Header["alg"].(string)
+		if !oidcSigningMethods[alg] || token.Method.Alg() != alg {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, ErrInvalidIDToken
+	}
+
+	// Parse checks exp, iat and nbf if present, but exp is required
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("%w: missing or expired exp", ErrInvalidIDToken)
+	}
+	if !claims.VerifyIssuer(p.config.Issuer, true) {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidIDToken)
+	}
+	if !claims.VerifyAudience(p.config.ClientID, true) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidIDToken)
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+
+	identity := &OIDCIdentity{Issuer: p.config.Issuer}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	identity.PreferredUsername, _ = claims["preferred_username"].(string)
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidIDToken)
+	}
+
+	return identity, nil
+}
+
+// Returns the user linked to the identity. Otherwise the identity is linked to
+// the user with the same verified email, or a new user is created.
+func (h *Handler) findOrCreateOIDCUser(ctx context.Context, identity *OIDCIdentity) (User, error) {
+	user, err := h.findLinkedOIDCUser(ctx, identity)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return user, err
+	}
+
+	user, linkErr := h.linkOIDCUser(ctx, identity)
+	if isUniqueViolation(linkErr, "subject") || isUniqueViolation(linkErr, "email") {
+		// A concurrent callback for the same identity got there first
+		user, err := h.findLinkedOIDCUser(ctx, identity)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user, linkErr
+		}
+		return user, err
+	}
+	return user, linkErr
+}
+
+// Returns the user already linked to the identity, or pgx.ErrNoRows
+func (h *Handler) findLinkedOIDCUser(ctx context.Context, identity *OIDCIdentity) (User, error) {
+	var user User
+	var disabled bool
+	err := h.conn.QueryRow(
+		ctx,
+		`SELECT u.id, u.username, u.email, u.role, u.disabled_at IS NOT NULL
+        FROM user_identities i JOIN users u ON u.id = i.user_id
+        WHERE i.issuer = $1 AND i.subject = $2`,
+		identity.Issuer, identity.Subject,
+	).Scan(&user.Id, &user.Username, &user.Email, &user.Role, &disabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return user, err
+	}
+	if err != nil {
+		return user, fmt.Errorf("error getting linked user: %w", err)
+	}
+	if disabled {
+		return user, ErrAccountDisabled
+	}
+	return user, nil
+}
+
+// Links the identity to the user with the same verified email, or to a new
+// user. The user and the link are written in one transaction, so a failed
+// link doesn't leave behind a user holding the email.
+func (h *Handler) linkOIDCUser(ctx context.Context, identity *OIDCIdentity) (User, error) {
+	var user User
+	var disabled bool
+
+	if identity.Email == "" {
+		return user, fmt.Errorf("%w: no email claim", ErrInvalidIDToken)
+	}
+
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		return user, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	linker := *h
+	linker.conn = tx
+
+	// Existing account with the same email. Only link if the provider vouches for the email.
+	err = tx.QueryRow(
+		ctx,
+		"SELECT id, username, email, role, disabled_at IS NOT NULL FROM users WHERE email = $1",
+		identity.Email,
+	).Scan(&user.Id, &user.Username, &user.Email, &user.Role, &disabled)
+	switch {
+	case err == nil:
+		if !identity.EmailVerified {
+			return user, ErrEmailNotVerified
+		}
+		if disabled {
+			return user, ErrAccountDisabled
+		}
+		if _, err := tx.Exec(
+			ctx,
+			"UPDATE users SET email_verified_at = COALESCE(email_verified_at, now()) WHERE id = $1",
+			user.Id,
+		); err != nil {
+			return user, fmt.Errorf("error verifying email: %w", err)
+		}
+
+	case errors.Is(err, pgx.ErrNoRows):
+		user, err = linker.createOIDCUser(ctx, identity)
+		if err != nil {
+			return user, err
+		}
+
+	default:
+		return user, fmt.Errorf("error getting user by email: %w", err)
+	}
+
+	if _, err := tx.Exec(
+		ctx,
+		"INSERT INTO user_identities (issuer, subject, user_id) VALUES ($1, $2, $3)",
+		identity.Issuer, identity.Subject, user.Id,
+	); err != nil {
+		return user, fmt.Errorf("error linking identity: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return user, fmt.Errorf("error linking identity: %w", err)
+	}
+
+	return user, nil
+}
+
+// Creates a user for an identity. The account gets a random password, so it
+// can only sign in through the provider until the user sets one.
+func (h *Handler) createOIDCUser(ctx context.Context, identity *OIDCIdentity) (User, error) {
+	var user User
+
+	username := identity.PreferredUsername
+	if username == "" {
+		username = identity.Name
+	}
+	if username == "" {
+		username, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	randomPassword, err := randomHex(32)
+	if err != nil {
+		return user, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return user, err
+	}
+
+	query := `
+    INSERT INTO users (username, email, password, has_password, email_verified_at)
+    VALUES (@username, @email, @password, false, CASE WHEN @verified::boolean THEN now() END)
+    RETURNING id, username, email, role
+    `
+	args := pgx.NamedArgs{
+		"username": username,
+		"email":    identity.Email,
+		"password": hashedPassword,
+		"verified": identity.EmailVerified,
+	}
+
+	// If the username is taken, retry with a random suffix. Each attempt runs
+	// in its own savepoint, since a failed insert would otherwise abort the
+	// caller's transaction.
+	for attempt := 1; ; attempt++ {
+		savepoint, err := h.conn.Begin(ctx)
+		if err != nil {
+			return user, fmt.Errorf("error starting transaction: %w", err)
+		}
+
+		err = savepoint.QueryRow(ctx, query, args).Scan(&user.Id, &user.Username, &user.Email, &user.Role)
+		if err == nil {
+			if err := savepoint.Commit(ctx); err != nil {
+				return user, fmt.Errorf("error adding user to database: %w", err)
+			}
+			return user, nil
+		}
+		savepoint.Rollback(ctx)
+		if !isUniqueViolation(err, "username") || attempt == oidcUsernameAttempts {
+			return user, fmt.Errorf("error adding user to database: %w", err)
+		}
+
+		suffix, err := randomHex(3)
+		if err != nil {
+			return user, err
+		}
+		args["username"] = username + "-" + suffix
+	}
+}
+
+// Sets or, with an empty state, clears the OIDC state cookie
+func setOIDCStateCookie(w http.ResponseWriter, state string) {
+	cookie := &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if state == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// Deletes expired states, left by logins that never reached the callback, until
+// ctx is cancelled
+func (h *Handler) sweepOIDCStates(ctx context.Context) {
+	ticker := time.NewTicker(oidcStateSweepEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := h.conn.Exec(ctx, "DELETE FROM oidc_states WHERE expires_at <= now()"); err != nil {
+				log.Printf("Error purging OIDC states: %v", err)
+			}
+		}
+	}
+}
+
+func (h *Handler) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		http.Error(w, ErrOIDCNotConfigured.Error(), http.StatusNotFound)
+		return
+	}
+
+	state, err := randomHex(32)
+	if err != nil {
+		http.Error(w, "Error generating state", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomHex(32)
+	if err != nil {
+		http.Error(w, "Error generating nonce", http.StatusInternalServerError)
+		return
+	}
+	verifier, _, err := newOpaqueToken()
+	if err != nil {
+		http.Error(w, "Error generating code verifier", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := h.oidc.authCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error building authorization URL: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	// Keep the nonce and verifier server-side until the callback
+	if _, err := h.conn.Exec(
+		context.Background(),
+		"INSERT INTO oidc_states (state_hash, nonce, code_verifier, expires_at) VALUES ($1, $2, $3, $4)",
+		hashToken(state), nonce, verifier, time.Now().Add(oidcStateTTL),
+	); err != nil {
+		http.Error(w, fmt.Sprintf("Error storing OIDC state: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Tie the login to this browser, so a callback URL for someone else's
+	// login can't sign it in
+	setOIDCStateCookie(w, state)
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (h *Handler) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		http.Error(w, ErrOIDCNotConfigured.Error(), http.StatusNotFound)
+		return
+	}
+
+	// The cookie is only good for one callback
+	setOIDCStateCookie(w, "")
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		http.Error(w, fmt.Sprintf("Identity provider error: %s %s", errCode, query.Get("error_description")), http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	code := query.Get("code")
+	if state == "" || code == "" {
+		http.Error(w, "Missing state or code parameter", http.StatusBadRequest)
+		return
+	}
+
+	// The state must match the cookie set on the browser that started the login
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "State doesn't match this browser", http.StatusBadRequest)
+		return
+	}
+
+	// Use up the state, only if it is still valid
+	var nonce, verifier string
+	err = h.conn.QueryRow(
+		context.Background(),
+		"DELETE FROM oidc_states WHERE state_hash = $1 AND expires_at > now() RETURNING nonce, code_verifier",
+		hashToken(state),
+	).Scan(&nonce, &verifier)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Invalid or expired state", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking OIDC state: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	rawIDToken, err := h.oidc.exchangeCode(r.Context(), code, verifier)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error exchanging code: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	identity, err := h.oidc.verifyIDToken(r.Context(), rawIDToken, nonce)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error validating ID token: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.findOrCreateOIDCUser(context.Background(), identity)
+	if err != nil {
+		if errors.Is(err, ErrEmailNotVerified) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrAccountDisabled) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error signing in: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Users with 2FA get a challenge to exchange for tokens with a code, the
+	// same as when signing in with a password
+	twoFactor, err := h.totpEnabled(context.Background(), user.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking two-factor authentication: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if twoFactor {
+		challenge, err := h.createLoginChallenge(context.Background(), user.Id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error creating login challenge: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if redirect := h.oidc.config.PostLoginRedirect; redirect != "" {
+			fragment := url.Values{
+				"two_factor_required": {"true"},
+				"challenge_token":     {challenge.ChallengeToken},
+				"expires_in":          {fmt.Sprint(challenge.ExpiresIn)},
+			}
+			http.Redirect(w, r, redirect+"#"+fragment.Encode(), http.StatusFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+
+	// create access and refresh tokens
+	tokens, err := h.issueTokens(context.Background(), user, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Hand the tokens to the frontend in the URL fragment, which isn't sent to servers
+	if redirect := h.oidc.config.PostLoginRedirect; redirect != "" {
+		fragment := url.Values{
+			"access_token":  {tokens.AccessToken},
+			"refresh_token": {tokens.RefreshToken},
+			"expires_in":    {fmt.Sprint(tokens.ExpiresIn)},
+		}
+		http.Redirect(w, r, redirect+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	writeTokenResponse(w, tokens)
+}
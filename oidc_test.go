@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+// Minimal identity provider serving discovery, a token endpoint that checks
+// PKCE and a JWKS with a single RSA key
+type mockIdP struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	code      string
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{key: key, code: "test-code"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcMetadata{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "test-key",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != idp.code || pkceChallenge(r.FormValue("code_verifier")) != idp.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.claims)
+		token.Header["kid"] = "test-key"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(oidcTokenResponse{IDToken: signed})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *mockIdP) provider() *OIDCProvider {
+	return NewOIDCProvider(OIDCConfig{
+		Issuer:      idp.server.URL,
+		ClientID:    "reader",
+		RedirectURL: "http://localhost/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+	}, idp.server.Client())
+}
+
+// Runs the authorization request and code exchange, returning the verified identity
+func (idp *mockIdP) login(t *testing.T, provider *OIDCProvider, nonce string) (*OIDCIdentity, error) {
+	t.Helper()
+	ctx := context.Background()
+
+	verifier, _, err := newOpaqueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := provider.authCodeURL(ctx, "state", nonce, verifier)
+	if err != nil {
+		t.Fatalf("Error building authorization URL: %v", err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method := parsed.Query().Get("code_challenge_method"); method != "S256" {
+		t.Errorf("Expected S256 code challenge; got %q", method)
+	}
+	idp.challenge = parsed.Query().Get("code_challenge")
+
+	rawIDToken, err := provider.exchangeCode(ctx, idp.code, verifier)
+	if err != nil {
+		t.Fatalf("Error exchanging code: %v", err)
+	}
+
+	return provider.verifyIDToken(ctx, rawIDToken, nonce)
+}
+
+func (idp *mockIdP) validClaims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"sub":            "user-1",
+		"aud":            "reader",
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "user@example.com",
+		"email_verified": true,
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.claims = idp.validClaims("nonce")
+
+	identity, err := idp.login(t, idp.provider(), "nonce")
+	if err != nil {
+		t.Fatalf("Expected valid ID token; got %v", err)
+	}
+	if identity.Subject != "user-1" || identity.Email != "user@example.com" || !identity.EmailVerified {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+}
+
+func TestOIDCLoginRejectsInvalidIDTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(claims jwt.MapClaims)
+	}{
+		{"wrong nonce", func(claims jwt.MapClaims) { claims["nonce"] = "other" }},
+		{"wrong audience", func(claims jwt.MapClaims) { claims["aud"] = "someone-else" }},
+		{"wrong issuer", func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" }},
+		{"expired", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{"no expiry", func(claims jwt.MapClaims) { delete(claims, "exp") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newMockIdP(t)
+			idp.claims = idp.validClaims("nonce")
+			tt.modify(idp.claims)
+
+			if _, err := idp.login(t, idp.provider(), "nonce"); !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("Expected %v; got %v", ErrInvalidIDToken, err)
+			}
+		})
+	}
+}
+
+func TestOIDCExchangeRequiresVerifier(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.claims = idp.validClaims("nonce")
+	idp.challenge = pkceChallenge("expected-verifier")
+
+	if _, err := idp.provider().exchangeCode(context.Background(), idp.code, "wrong-verifier"); err == nil {
+		t.Error("Expected code exchange with wrong verifier to fail")
+	}
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+	}{
+		{"no cookie", nil},
+		{"other state", &http.Cookie{Name: oidcStateCookie, Value: "other-state"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockPool, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockPool.Close()
+
+			handler := &Handler{conn: mockPool, oidc: newMockIdP(t).provider()}
+
+			req := httptest.NewRequest(http.MethodGet, "/oidc/callback?state=state&code=code", nil)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			rr := httptest.NewRecorder()
+			handler.handleOIDCCallback(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d; got %d", http.StatusBadRequest, rr.Code)
+			}
+			if err := mockPool.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateOIDCUserRetriesTakenUsername(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPool.Close()
+
+	// Each attempt runs in a savepoint
+	taken := &pgconn.PgError{Code: "23505", ConstraintName: "users_username_key"}
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("INSERT INTO users").
+		WithArgs("alice", "alice@example.com", pgxmock.AnyArg(), true).
+		WillReturnError(taken)
+	mockPool.ExpectRollback()
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("INSERT INTO users").
+		WithArgs(pgxmock.AnyArg(), "alice@example.com", pgxmock.AnyArg(), true).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "role"}).AddRow("u1", "alice-1a2b3c", "alice@example.com", RoleUser))
+	mockPool.ExpectCommit()
+
+	handler := &Handler{conn: mockPool}
+	user, err := handler.createOIDCUser(context.Background(), &OIDCIdentity{
+		Email:             "alice@example.com",
+		EmailVerified:     true,
+		PreferredUsername: "alice",
+	})
+	if err != nil {
+		t.Fatalf("Expected user to be created; got %v", err)
+	}
+	if user.Username != "alice-1a2b3c" {
+		t.Errorf("Expected suffixed username; got %q", user.Username)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+// A new user whose identity can't be linked is rolled back rather than left
+// holding the email
+func TestFindOrCreateOIDCUserRollsBack(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPool.Close()
+
+	identity := &OIDCIdentity{Issuer: "https://idp.example.com", Subject: "sub-1", Email: "alice@example.com", EmailVerified: true, PreferredUsername: "alice"}
+
+	mockPool.ExpectQuery("FROM user_identities").
+		WithArgs(identity.Issuer, identity.Subject).
+		WillReturnError(pgx.ErrNoRows)
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("SELECT id, username, email, role, (.+) FROM users WHERE email").
+		WithArgs("alice@example.com").
+		WillReturnError(pgx.ErrNoRows)
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("INSERT INTO users").
+		WithArgs("alice", "alice@example.com", pgxmock.AnyArg(), true).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "role"}).AddRow("u1", "alice", "alice@example.com", RoleUser))
+	mockPool.ExpectCommit()
+	mockPool.ExpectExec("INSERT INTO user_identities").
+		WithArgs(identity.Issuer, identity.Subject, "u1").
+		WillReturnError(errors.New("connection lost"))
+	mockPool.ExpectRollback()
+
+	handler := &Handler{conn: mockPool}
+	if _, err := handler.findOrCreateOIDCUser(context.Background(), identity); err == nil {
+		t.Error("Expected an error linking the identity")
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+// Signing in through the provider doesn't skip the second factor
+func TestOIDCCallbackRequiresSecondFactor(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPool.Close()
+
+	idp := newMockIdP(t)
+	idp.claims = idp.validClaims("nonce")
+	idp.challenge = pkceChallenge("verifier")
+
+	mockPool.ExpectQuery("DELETE FROM oidc_states").
+		WithArgs(hashToken("state")).
+		WillReturnRows(pgxmock.NewRows([]string{"nonce", "code_verifier"}).AddRow("nonce", "verifier"))
+	mockPool.ExpectQuery("FROM user_identities").
+		WithArgs(idp.server.URL, "user-1").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "role", "disabled"}).AddRow("u1", "user", "user@example.com", RoleUser, false))
+	mockPool.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM user_totp").
+		WithArgs("u1").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+	mockPool.ExpectExec("INSERT INTO login_challenges").
+		WithArgs(pgxmock.AnyArg(), "u1", pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	handler := &Handler{conn: mockPool, keys: newHMACKeySet("test-secret"), oidc: idp.provider()}
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/callback?state=state&code="+idp.code, nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: "state"})
+	rr := httptest.NewRecorder()
+	handler.handleOIDCCallback(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d; got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var response LoginChallengeResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if !response.TwoFactorRequired || response.ChallengeToken == "" {
+		t.Errorf("Expected a login challenge; got %+v", response)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
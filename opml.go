@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/net/html/charset"
+)
+
+// Maximum size of an uploaded OPML file
+const maxOPMLSize = 5 << 20
+
+type OPML struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    OPMLHead `xml:"head"`
+	Body    OPMLBody `xml:"body"`
+}
+
+type OPMLHead struct {
+	Title       string `xml:"title"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+type OPMLBody struct {
+	Outlines []OPMLOutline `xml:"outline"`
+}
+
+type OPMLOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	XMLURL   string        `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string        `xml:"htmlUrl,attr,omitempty"`
+	Outlines []OPMLOutline `xml:"outline"`
+}
+
+type OPMLImportEntry struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Url    string `json:"url,omitempty"`
+	Folder string `json:"folder,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type OPMLImportReport struct {
+	Created []OPMLImportEntry `json:"created"`
+	Skipped []OPMLImportEntry `json:"skipped"`
+	Invalid []OPMLImportEntry `json:"invalid"`
+	// Feeds to poll once the import is committed
+	newFeeds []feedRow
+}
+
+const (
+	opmlEntryFolder       = "folder"
+	opmlEntrySubscription = "subscription"
+)
+
+// Title of an outline, preferring the title attribute over text
+func (o OPMLOutline) name() string {
+	if o.Title != "" {
+		return o.Title
+	}
+	return o.Text
+}
+
+// Reads the OPML document from a multipart "file" field or the raw request body
+func readOPML(r *http.Request) (*OPML, error) {
+	var body io.Reader = r.Body
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, fmt.Errorf("Missing file field: %v", err)
+		}
+		defer file.Close()
+		body = file
+	}
+
+	var doc OPML
+	decoder := xml.NewDecoder(body)
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("Invalid OPML document: %v", err)
+	}
+
+	return &doc, nil
+}
+
+// Checks that a feed URL is an absolute http(s) URL
+func validFeedURL(rawURL string) bool {
+	parsedURL, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		return false
+	}
+	return (parsedURL.Scheme == "http" || parsedURL.Scheme == "https") && parsedURL.Host != ""
+}
+
+func (h *Handler) handleImportOPML(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxOPMLSize)
+
+	doc, err := readOPML(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The import runs in one transaction so a failure doesn't leave part of it behind
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	importer := *h
+	importer.conn = tx
+
+	report := &OPMLImportReport{
+		Created: []OPMLImportEntry{},
+		Skipped: []OPMLImportEntry{},
+		Invalid: []OPMLImportEntry{},
+	}
+	if err := importer.importOutlines(ctx, userToken.Id, doc.Body.Outlines, nil, "", report); err != nil {
+		http.Error(w, fmt.Sprintf("Error importing OPML, nothing was imported: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error importing OPML, nothing was imported: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch items for new feeds now rather than waiting for the next poll
+	if h.poller != nil {
+		for _, feed := range report.newFeeds {
+			h.poller.Enqueue(feed.Id, feed.Url)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Imports outlines into the given folder (nil for unfiled). Outlines with an
+// xmlUrl become subscriptions. Outlines with children, or with no type (as
+// exported for empty folders), become subfolders of the given folder.
+func (h *Handler) importOutlines(ctx context.Context, userID string, outlines []OPMLOutline, folderID *string, folderName string, report *OPMLImportReport) error {
+	for _, outline := range outlines {
+		switch {
+		case outline.XMLURL != "":
+			if err := h.importSubscription(ctx, userID, outline, folderID, folderName, report); err != nil {
+				return err
+			}
+
+		case len(outline.Outlines) > 0, outline.Type == "":
+			name := outline.name()
+			if name == "" {
+				report.Invalid = append(report.Invalid, OPMLImportEntry{
+					Type:   opmlEntryFolder,
+					Reason: "Missing folder name",
+				})
+				continue
+			}
+
+			id, err := h.importFolder(ctx, userID, name, folderID, report)
+			if err != nil {
+				return err
+			}
+
+			if err := h.importOutlines(ctx, userID, outline.Outlines, &id, name, report); err != nil {
+				return err
+			}
+
+		default:
+			report.Invalid = append(report.Invalid, OPMLImportEntry{
+				Type:   opmlEntrySubscription,
+				Title:  outline.name(),
+				Folder: folderName,
+				Reason: "Missing xmlUrl",
+			})
+		}
+	}
+
+	return nil
+}
+
+// Returns the id of the user's folder with this name under parentID (nil for
+// the top level), creating it if needed
+func (h *Handler) importFolder(ctx context.Context, userID string, name string, parentID *string, report *OPMLImportReport) (string, error) {
+	entry := OPMLImportEntry{Type: opmlEntryFolder, Title: name}
+
+	var id string
+	err := h.conn.QueryRow(
+		ctx,
+		"SELECT id FROM folders WHERE user_id = $1 AND name = $2 AND parent_id IS NOT DISTINCT FROM $3 LIMIT 1",
+		userID, name, parentID,
+	).Scan(&id)
+	if err == nil {
+		entry.Reason = "Folder already exists"
+		report.Skipped = append(report.Skipped, entry)
+		return id, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("error getting folder %s: %w", name, err)
+	}
+
+	query := `
+    INSERT INTO folders (user_id, name, sort_order, parent_id)
+    VALUES ($1, $2, ` + nextFolderSortOrder + `, $3)
+    RETURNING id
+    `
+	if err := h.conn.QueryRow(ctx, query, userID, name, parentID).Scan(&id); err != nil {
+		return "", fmt.Errorf("error adding folder %s: %w", name, err)
+	}
+
+	report.Created = append(report.Created, entry)
+	return id, nil
+}
+
+func (h *Handler) importSubscription(ctx context.Context, userID string, outline OPMLOutline, folderID *string, folderName string, report *OPMLImportReport) error {
+	entry := OPMLImportEntry{
+		Type:   opmlEntrySubscription,
+		Title:  outline.name(),
+		Url:    outline.XMLURL,
+		Folder: folderName,
+	}
+
+	if !validFeedURL(outline.XMLURL) {
+		entry.Reason = "Invalid feed URL"
+		report.Invalid = append(report.Invalid, entry)
+		return nil
+	}
+
+	// Feeds are only added once the subscription is known to be allowed
+	var exists bool
+	if err := h.conn.QueryRow(
+		ctx,
+		"SELECT EXISTS(SELECT 1 FROM subscriptions s JOIN feeds f ON f.id = s.feed_id WHERE s.user_id = $1 AND f.url = $2)",
+		userID, outline.XMLURL,
+	).Scan(&exists); err != nil {
+		return fmt.Errorf("error checking subscription %s: %w", outline.XMLURL, err)
+	}
+	if exists {
+		entry.Reason = "Already subscribed"
+		report.Skipped = append(report.Skipped, entry)
+		return nil
+	}
+
+	// Unverified users can only have a limited number of subscriptions
+	if err := h.checkSubscriptionLimit(ctx, userID, 1); err != nil {
+		if !errors.Is(err, ErrVerificationRequired) {
+			return err
+		}
+		entry.Reason = err.Error()
+		report.Invalid = append(report.Invalid, entry)
+		return nil
+	}
+
+	// Feeds get their title from the feed itself when polled
+	var feedID int
+	if err := h.conn.QueryRow(
+		ctx,
+		"INSERT INTO feeds (url, title) VALUES ($1, '') ON CONFLICT (url) DO UPDATE SET url = EXCLUDED.url RETURNING id",
+		outline.XMLURL,
+	).Scan(&feedID); err != nil {
+		return fmt.Errorf("error adding feed %s: %w", outline.XMLURL, err)
+	}
+
+	// The outline's title is the subscriber's own
+	if _, err := h.conn.Exec(
+		ctx,
+		"INSERT INTO subscriptions (user_id, feed_id, folder_id, title) VALUES ($1, $2, $3, NULLIF($4, ''))",
+		userID, feedID, folderID, outline.name(),
+	); err != nil {
+		return fmt.Errorf("error adding subscription %s: %w", outline.XMLURL, err)
+	}
+
+	report.newFeeds = append(report.newFeeds, feedRow{Id: feedID, Url: outline.XMLURL})
+	report.Created = append(report.Created, entry)
+	return nil
+}
+
+// Builds an OPML document of the user's subscriptions, nested under their folders
+func (h *Handler) buildOPML(ctx context.Context, userID string) (*OPML, error) {
+	doc := &OPML{
+		Version: "2.0",
+		Head: OPMLHead{
+			Title:       "Reader subscriptions",
+			DateCreated: time.Now().UTC().Format(time.RFC1123Z),
+		},
+	}
+
+	rows, err := h.conn.Query(ctx, "SELECT id, name, parent_id FROM folders WHERE user_id = $1 ORDER BY sort_order, name", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting folders: %w", err)
+	}
+	defer rows.Close()
+
+	var folders []UserFolder
+	folderIDs := map[string]bool{}
+	for rows.Next() {
+		var folder UserFolder
+		if err := rows.Scan(&folder.Id, &folder.Name, &folder.ParentId); err != nil {
+			return nil, fmt.Errorf("error scanning folder row: %w", err)
+		}
+		folders = append(folders, folder)
+		folderIDs[folder.Id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over folders: %w", err)
+	}
+
+	query := `
+    SELECT COALESCE(s.title, f.title, ''), f.url, s.folder_id
+    FROM subscriptions s
+    JOIN feeds f ON f.id = s.feed_id
+    WHERE s.user_id = $1
+    ORDER BY 1
+    `
+	subRows, err := h.conn.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting subscriptions: %w", err)
+	}
+	defer subRows.Close()
+
+	var unfiled []OPMLOutline
+	filed := map[string][]OPMLOutline{}
+	for subRows.Next() {
+		var title, feedURL string
+		var folderID *string
+		if err := subRows.Scan(&title, &feedURL, &folderID); err != nil {
+			return nil, fmt.Errorf("error scanning subscription row: %w", err)
+		}
+
+		outline := OPMLOutline{
+			Text:   title,
+			Title:  title,
+			Type:   "rss",
+			XMLURL: feedURL,
+		}
+
+		if folderID != nil && folderIDs[*folderID] {
+			filed[*folderID] = append(filed[*folderID], outline)
+			continue
+		}
+		unfiled = append(unfiled, outline)
+	}
+	if err := subRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over subscriptions: %w", err)
+	}
+
+	// Folder outlines in the order they were queried, with subfolders before
+	// the folder's own subscriptions
+	var folderOutline func(folder UserFolder) OPMLOutline
+	folderOutline = func(folder UserFolder) OPMLOutline {
+		outline := OPMLOutline{Text: folder.Name, Title: folder.Name}
+		for _, child := range folder.Children {
+			outline.Outlines = append(outline.Outlines, folderOutline(child))
+		}
+		outline.Outlines = append(outline.Outlines, filed[folder.Id]...)
+		return outline
+	}
+
+	for _, folder := range buildFolderTree(folders) {
+		doc.Body.Outlines = append(doc.Body.Outlines, folderOutline(folder))
+	}
+	doc.Body.Outlines = append(doc.Body.Outlines, unfiled...)
+
+	return doc, nil
+}
+
+// Writes an OPML document with the XML declaration
+func writeOPML(w io.Writer, doc *OPML) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+func (h *Handler) handleExportOPML(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	doc, err := h.buildOPML(context.Background(), userToken.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error exporting OPML: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-opml+xml; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="subscriptions.opml"`)
+	if err := writeOPML(w, doc); err != nil {
+		log.Printf("Error writing OPML for user %s: %v", userToken.Id, err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestBuildOPMLNestsSubscriptions(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	folderID, subfolderID := "f1", "f2"
+	mockPool.ExpectQuery("SELECT id, name, parent_id FROM folders").
+		WithArgs("u1").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "name", "parent_id"}).
+			AddRow("f1", "Tech", (*string)(nil)).
+			AddRow("f2", "Go", &folderID))
+	mockPool.ExpectQuery("FROM subscriptions s").
+		WithArgs("u1").
+		WillReturnRows(pgxmock.NewRows([]string{"title", "url", "folder_id"}).
+			AddRow("Filed", "https://example.com/filed.xml", &folderID).
+			AddRow("Nested", "https://example.com/nested.xml", &subfolderID).
+			AddRow("Unfiled", "https://example.com/unfiled.xml", (*string)(nil)))
+
+	handler := &Handler{conn: mockPool}
+	doc, err := handler.buildOPML(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeOPML(&buf, doc); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var parsed OPML
+	if err := xml.Unmarshal(buf.Bytes(), &parsed); err != nil {
+		t.Fatalf("Exported OPML doesn't parse: %v", err)
+	}
+
+	outlines := parsed.Body.Outlines
+	if len(outlines) != 2 {
+		t.Fatalf("Expected 2 top-level outlines; got %d", len(outlines))
+	}
+	if outlines[0].Text != "Tech" || len(outlines[0].Outlines) != 2 || outlines[0].Outlines[1].XMLURL != "https://example.com/filed.xml" {
+		t.Fatalf("Unexpected folder outline: %+v", outlines[0])
+	}
+	subfolder := outlines[0].Outlines[0]
+	if subfolder.Text != "Go" || len(subfolder.Outlines) != 1 || subfolder.Outlines[0].XMLURL != "https://example.com/nested.xml" {
+		t.Errorf("Unexpected subfolder outline: %+v", subfolder)
+	}
+	if outlines[1].XMLURL != "https://example.com/unfiled.xml" {
+		t.Errorf("Unexpected unfiled outline: %+v", outlines[1])
+	}
+}
+
+func TestImportSubscriptionChecksLimitBeforeAddingFeed(t *testing.T) {
+	t.Setenv("UNVERIFIED_MAX_SUBSCRIPTIONS", "1")
+
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("SELECT EXISTS").
+		WithArgs("u1", "https://example.com/feed.xml").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(false))
+	mockPool.ExpectQuery("SELECT u.email_verified_at IS NOT NULL").
+		WithArgs("u1").
+		WillReturnRows(pgxmock.NewRows([]string{"verified", "count"}).AddRow(false, 1))
+
+	handler := &Handler{conn: mockPool}
+	report := &OPMLImportReport{}
+	outline := OPMLOutline{Text: "Example", XMLURL: "https://example.com/feed.xml"}
+	if err := handler.importSubscription(context.Background(), "u1", outline, nil, "", report); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(report.Invalid) != 1 || len(report.newFeeds) != 0 {
+		t.Errorf("Expected the subscription to be rejected: %+v", report)
+	}
+	// No feed row is inserted
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// The outline's title belongs to the subscriber, so it is stored on the
+// subscription and never on the feed, which takes its title from polling
+func TestImportSubscriptionKeepsTitle(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("SELECT EXISTS").
+		WithArgs("u1", "https://example.com/feed.xml").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(false))
+	mockPool.ExpectQuery("SELECT u.email_verified_at IS NOT NULL").
+		WithArgs("u1").
+		WillReturnRows(pgxmock.NewRows([]string{"verified", "count"}).AddRow(true, 0))
+	mockPool.ExpectQuery("INSERT INTO feeds \\(url, title\\) VALUES \\(\\$1, ''\\)").
+		WithArgs("https://example.com/feed.xml").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(7))
+	mockPool.ExpectExec("INSERT INTO subscriptions").
+		WithArgs("u1", 7, (*string)(nil), "My Example").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	handler := &Handler{conn: mockPool}
+	report := &OPMLImportReport{}
+	outline := OPMLOutline{Text: "My Example", XMLURL: "https://example.com/feed.xml"}
+	if err := handler.importSubscription(context.Background(), "u1", outline, nil, "", report); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(report.Created) != 1 || len(report.newFeeds) != 1 {
+		t.Errorf("Expected the subscription to be created: %+v", report)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleImportOPMLRollsBackOnError(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("SELECT id FROM folders").
+		WithArgs("u1", "Tech", (*string)(nil)).
+		WillReturnError(errors.New("boom"))
+	mockPool.ExpectRollback()
+
+	body := `<opml version="2.0"><body><outline text="Tech"><outline text="Feed" xmlUrl="https://example.com/feed.xml"/></outline></body></opml>`
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/import-opml", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleImportOPML(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d; got %d", http.StatusInternalServerError, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImportOutlinesCreatesEmptyFolders(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("SELECT id FROM folders").
+		WithArgs("u1", "Empty", (*string)(nil)).
+		WillReturnError(pgx.ErrNoRows)
+	mockPool.ExpectQuery("INSERT INTO folders").
+		WithArgs("u1", "Empty", (*string)(nil)).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow("f1"))
+
+	// As exported by buildOPML for an empty folder, plus a feed outline missing its URL
+	outlines := []OPMLOutline{
+		{Text: "Empty", Title: "Empty"},
+		{Text: "Broken", Type: "rss"},
+	}
+
+	handler := &Handler{conn: mockPool}
+	report := &OPMLImportReport{}
+	if err := handler.importOutlines(context.Background(), "u1", outlines, nil, "", report); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(report.Created) != 1 || report.Created[0].Type != opmlEntryFolder {
+		t.Errorf("Expected the empty folder to be created: %+v", report.Created)
+	}
+	if len(report.Invalid) != 1 || report.Invalid[0].Title != "Broken" {
+		t.Errorf("Expected the feed outline to be invalid: %+v", report.Invalid)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	outboundTimeout      = 30 * time.Second
+	outboundMaxRedirects = 10
+)
+
+var (
+	ErrBlockedScheme  = errors.New("URL scheme not allowed")
+	ErrBlockedAddress = errors.New("destination address not allowed")
+)
+
+// Ranges that aren't covered by the net.IP helpers but must not be reachable
+var blockedNets = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"100.64.0.0/10",  // carrier-grade NAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved, including broadcast
+	"64:ff9b::/96",   // NAT64
+	"64:ff9b:1::/48", // local-use NAT64
+	"2001:db8::/32",  // documentation
+	"2002::/16",      // 6to4, which can embed any IPv4 address
+)
+
+// Restrictions applied to server-side fetches of user-supplied URLs
+type OutboundConfig struct {
+	// Schemes that may be requested, including on redirects
+	AllowedSchemes []string
+	// Hostnames that bypass the address check, e.g. an internal test feed
+	AllowedHosts []string
+	// Networks that bypass the address check
+	AllowedNets []*net.IPNet
+}
+
+// Reads the outbound config from the environment:
+//
+//	OUTBOUND_ALLOWED_SCHEMES  comma-separated schemes, default "http,https"
+//	OUTBOUND_ALLOWED_HOSTS    comma-separated hostnames exempt from the address check
+//	OUTBOUND_ALLOWED_CIDRS    comma-separated networks exempt from the address check
+func loadOutboundConfig() (OutboundConfig, error) {
+	config := OutboundConfig{
+		AllowedSchemes: splitList(os.Getenv("OUTBOUND_ALLOWED_SCHEMES")),
+		AllowedHosts:   splitList(os.Getenv("OUTBOUND_ALLOWED_HOSTS")),
+	}
+	if len(config.AllowedSchemes) == 0 {
+		config.AllowedSchemes = []string{"http", "https"}
+	}
+
+	for _, cidr := range splitList(os.Getenv("OUTBOUND_ALLOWED_CIDRS")) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return config, fmt.Errorf("Invalid OUTBOUND_ALLOWED_CIDRS entry %q: %v", cidr, err)
+		}
+		config.AllowedNets = append(config.AllowedNets, network)
+	}
+
+	return config, nil
+}
+
+// Creates a client that refuses to connect to private, loopback, link-local and
+// other internal addresses, checking every resolved address including on redirects
+func newOutboundClient(config OutboundConfig) *http.Client {
+	dialer := &outboundDialer{
+		config:   config,
+		dialer:   &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second},
+		resolver: net.DefaultResolver,
+	}
+
+	transport := &http.Transport{
+		// Never use an environment proxy, which would bypass the address check
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout:   outboundTimeout,
+		Transport: &schemeCheckingTransport{config: config, next: transport},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= outboundMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", outboundMaxRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+// Checks that a URL's scheme is on the allowlist
+func (c OutboundConfig) checkURL(u *url.URL) error {
+	for _, scheme := range c.AllowedSchemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrBlockedScheme, u.Scheme)
+}
+
+func (c OutboundConfig) hostAllowed(host string) bool {
+	for _, allowed := range c.AllowedHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c OutboundConfig) ipAllowed(ip net.IP) bool {
+	for _, network := range c.AllowedNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return !isBlockedIP(ip)
+}
+
+// Reports whether an address is internal or otherwise not publicly routable
+func isBlockedIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+
+	for _, network := range blockedNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Applies the scheme allowlist to every request, including redirects
+type schemeCheckingTransport struct {
+	config OutboundConfig
+	next   http.RoundTripper
+}
+
+func (t *schemeCheckingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.config.checkURL(req.URL); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// Resolves hostnames itself and dials only addresses that pass the check, so a
+// DNS answer can't change between the check and the connection
+type outboundDialer struct {
+	config   OutboundConfig
+	dialer   *net.Dialer
+	resolver *net.Resolver
+}
+
+func (d *outboundDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.config.hostAllowed(host) {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error = fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+	for _, addr := range addrs {
+		if !d.config.ipAllowed(addr.IP) {
+			continue
+		}
+
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// Splits a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
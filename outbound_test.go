@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsBlockedIP(t *testing.T) {
+	blocked := []string{
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"100.64.0.1", "0.0.0.0", "255.255.255.255", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1",
+	}
+	for _, addr := range blocked {
+		if !isBlockedIP(net.ParseIP(addr)) {
+			t.Errorf("Expected %s to be blocked", addr)
+		}
+	}
+
+	allowed := []string{"93.184.216.34", "2606:4700::1111"}
+	for _, addr := range allowed {
+		if isBlockedIP(net.ParseIP(addr)) {
+			t.Errorf("Expected %s to be allowed", addr)
+		}
+	}
+}
+
+func TestOutboundClientBlocksLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := newOutboundClient(OutboundConfig{AllowedSchemes: []string{"http", "https"}})
+	if _, err := client.Get(server.URL); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Expected %v; got %v", ErrBlockedAddress, err)
+	}
+}
+
+func TestOutboundClientBlocksRedirectToLoopback(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer internal.Close()
+
+	// The first hop is allowed by hostname, the redirect target by nothing
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		port := internal.Listener.Addr().(*net.TCPAddr).Port
+		http.Redirect(w, r, fmt.Sprintf("http://127.0.0.2:%d/", port), http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	client := newOutboundClient(OutboundConfig{
+		AllowedSchemes: []string{"http"},
+		AllowedHosts:   []string{"127.0.0.1"},
+	})
+	if _, err := client.Get(redirect.URL); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("Expected %v; got %v", ErrBlockedAddress, err)
+	}
+}
+
+func TestOutboundClientAllowedCIDR(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	client := newOutboundClient(OutboundConfig{
+		AllowedSchemes: []string{"http"},
+		AllowedNets:    []*net.IPNet{loopback},
+	})
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestOutboundClientBlocksScheme(t *testing.T) {
+	client := newOutboundClient(OutboundConfig{AllowedSchemes: []string{"https"}})
+	if _, err := client.Get("http://example.com"); !errors.Is(err, ErrBlockedScheme) {
+		t.Errorf("Expected %v; got %v", ErrBlockedScheme, err)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/mmcdole/gofeed"
+)
+
+const (
+	defaultPollInterval = 15 * time.Minute
+	pollConcurrency     = 4
+	pollQueueSize       = 256
+	pollTimeout         = 30 * time.Second
+	pollUserAgent       = "reader-api/1.0"
+	// Feeds larger than this are refused rather than read into memory
+	maxFeedBytes = 10 << 20
+)
+
+type feedRow struct {
+	Id           int
+	Url          string
+	ETag         string
+	LastModified string
+	// Items published before this are purged for every subscriber, so aren't
+	// stored. Nil means the poller's default retention.
+	Cutoff *time.Time
+}
+
+// Cutoff for a feed from the longest retention among its subscribers. Shorter
+// overrides are applied when reading, by retentionFilter. Expects the default
+// cutoff in $1 and a query joining feeds f.
+const feedCutoffQuery = `COALESCE((
+    SELECT MIN(COALESCE(now() - s.retention_days * interval '1 day', $1))
+    FROM subscriptions s
+    WHERE s.feed_id = f.id
+), $1)`
+
+// Periodically fetches every feed and stores its items
+type Poller struct {
+	conn     PgxInterface
+	client   *http.Client
+	interval time.Duration
+	// Items are kept forever if zero
+	retention time.Duration
+	queue     chan feedRow
+}
+
+func NewPoller(conn PgxInterface, client *http.Client, interval time.Duration, retention time.Duration) *Poller {
+	return &Poller{
+		conn:      conn,
+		client:    client,
+		interval:  interval,
+		retention: retention,
+		queue:     make(chan feedRow, pollQueueSize),
+	}
+}
+
+// Reads the poll interval from POLL_INTERVAL (e.g. "10m"), falling back to the default
+func getPollInterval() time.Duration {
+	return getDurationEnv("POLL_INTERVAL", defaultPollInterval)
+}
+
+// Reads how long items are kept from ITEM_RETENTION (e.g. "720h"). Items are
+// never purged unless it's set.
+func getRetention() time.Duration {
+	return getDurationEnv("ITEM_RETENTION", 0)
+}
+
+// Oldest publish date worth keeping, or nil if items are kept forever
+func (p *Poller) defaultCutoff() *time.Time {
+	if p.retention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-p.retention)
+	return &cutoff
+}
+
+// Polls all feeds immediately and then on every tick until ctx is cancelled.
+// Feeds passed to Enqueue are polled as soon as they arrive.
+func (p *Poller) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	p.pollAll(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.pollAll(ctx)
+		case feed := <-p.queue:
+			if err := p.pollFeed(ctx, feed); err != nil {
+				log.Printf("Error polling feed %d (%s): %v", feed.Id, feed.Url, err)
+			}
+		}
+	}
+}
+
+// Schedules a feed to be polled ahead of the next tick, e.g. right after it is subscribed to.
+// The feed is fetched unconditionally. If the queue is full it is left for the regular poll.
+func (p *Poller) Enqueue(id int, url string) {
+	select {
+	case p.queue <- feedRow{Id: id, Url: url}:
+	default:
+	}
+}
+
+// Polls every subscribed feed, then purges expired items if retention is set
+// and expired data export archives
+func (p *Poller) pollAll(ctx context.Context) {
+	query := `
+    SELECT f.id, f.url, f.etag, f.last_modified,
+        CASE WHEN $1::timestamptz IS NOT NULL THEN ` + feedCutoffQuery + ` END
+    FROM feeds f
+    WHERE EXISTS (SELECT 1 FROM subscriptions s WHERE s.feed_id = f.id)
+    `
+	rows, err := p.conn.Query(ctx, query, p.defaultCutoff())
+	if err != nil {
+		log.Printf("Error getting feeds to poll: %v", err)
+		return
+	}
+
+	feeds, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (feedRow, error) {
+		var feed feedRow
+		err := row.Scan(&feed.Id, &feed.Url, &feed.ETag, &feed.LastModified, &feed.Cutoff)
+		return feed, err
+	})
+	if err != nil {
+		log.Printf("Error scanning feeds to poll: %v", err)
+		return
+	}
+
+	// Poll feeds concurrently, limited to pollConcurrency at a time
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, pollConcurrency)
+	for _, feed := range feeds {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(feed feedRow) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := p.pollFeed(ctx, feed); err != nil {
+				log.Printf("Error polling feed %d (%s): %v", feed.Id, feed.Url, err)
+			}
+		}(feed)
+	}
+	wg.Wait()
+
+	if p.retention > 0 {
+		if err := p.purgeItems(ctx); err != nil {
+			log.Printf("Error purging items: %v", err)
+		}
+	}
+
+	if err := p.purgeExpiredExports(ctx); err != nil {
+		log.Printf("Error purging expired data exports: %v", err)
+	}
+}
+
+// Deletes items published before the retention period, keeping starred items.
+// Items are kept for as long as any subscriber's retention override asks for.
+func (p *Poller) purgeItems(ctx context.Context) error {
+	query := `
+    DELETE FROM items i
+    USING feeds f
+    WHERE f.id = i.feed_id
+        AND i.published < ` + feedCutoffQuery + `
+        AND NOT EXISTS (SELECT 1 FROM starred_items st WHERE st.item_id = i.id)
+    `
+	_, err := p.conn.Exec(ctx, query, p.defaultCutoff())
+	return err
+}
+
+// Drops the archives of expired data exports. The rows are kept so their
+// status can still be read.
+func (p *Poller) purgeExpiredExports(ctx context.Context) error {
+	_, err := p.conn.Exec(ctx, "UPDATE data_exports SET archive = NULL WHERE expires_at <= now() AND archive IS NOT NULL")
+	return err
+}
+
+// Fetches and parses a single feed, upserts its items and updates last_checked.
+// The stored ETag and Last-Modified values are sent as validators, and a 304
+// response is treated as no new items.
+func (p *Poller) pollFeed(ctx context.Context, feed feedRow) error {
+	ctx, cancel := context.WithTimeout(ctx, pollTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed.Url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("User-Agent", pollUserAgent)
+	if feed.ETag != "" {
+		req.Header.Set("If-None-Match", feed.ETag)
+	}
+	if feed.LastModified != "" {
+		req.Header.Set("If-Modified-Since", feed.LastModified)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching feed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		if _, err := p.conn.Exec(ctx, "UPDATE feeds SET last_checked = now() WHERE id = $1", feed.Id); err != nil {
+			return fmt.Errorf("error updating feed: %w", err)
+		}
+		return nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("received %d response", resp.StatusCode)
+	}
+
+	// Read one byte past the limit to tell a feed that fits from one that was cut off
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedBytes+1))
+	if err != nil {
+		return fmt.Errorf("error reading feed: %w", err)
+	}
+	if len(body) > maxFeedBytes {
+		return fmt.Errorf("feed is larger than %d bytes", maxFeedBytes)
+	}
+
+	fp := gofeed.NewParser()
+	parsed, err := fp.Parse(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error parsing feed: %w", err)
+	}
+
+	cutoff := feed.Cutoff
+	if cutoff == nil {
+		cutoff = p.defaultCutoff()
+	}
+	if err := p.storeItems(ctx, feed.Id, parsed.Items, cutoff); err != nil {
+		return err
+	}
+
+	// The feed's own title replaces whatever title it was first added with
+	query := `
+    UPDATE feeds
+    SET last_checked = now(), description = $2, etag = $3, last_modified = $4, title = COALESCE(NULLIF($5, ''), title)
+    WHERE id = $1
+    `
+	if _, err := p.conn.Exec(
+		ctx, query,
+		feed.Id, parsed.Description, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), parsed.Title,
+	); err != nil {
+		return fmt.Errorf("error updating feed: %w", err)
+	}
+
+	return nil
+}
+
+// Stores items, skipping any published before cutoff unless it's nil
+func (p *Poller) storeItems(ctx context.Context, feedID int, items []*gofeed.Item, cutoff *time.Time) error {
+	query := `
+    INSERT INTO items (feed_id, guid, title, link, content, description, author, published)
+    VALUES (@feed_id, @guid, @title, @link, @content, @description, @author, COALESCE(@published, now()))
+    ON CONFLICT (feed_id, guid) DO UPDATE SET
+        title = EXCLUDED.title,
+        link = EXCLUDED.link,
+        content = EXCLUDED.content,
+        description = EXCLUDED.description,
+        author = EXCLUDED.author,
+        published = COALESCE(@published, items.published),
+        updated_at = now()
+    `
+
+	// Skip items that would be purged straight away
+	for _, item := range items {
+		guid := itemGUID(item)
+		if guid == "" {
+			continue
+		}
+
+		published := itemPublished(item)
+		if cutoff != nil && published != nil && published.Before(*cutoff) {
+			continue
+		}
+
+		link := sanitizeLink(item.Link)
+		args := pgx.NamedArgs{
+			"feed_id":     feedID,
+			"guid":        guid,
+			"title":       item.Title,
+			"link":        link,
+			"content":     sanitizeHTML(item.Content, link),
+			"description": sanitizeHTML(item.Description, link),
+			"author":      itemAuthor(item),
+			"published":   published,
+		}
+		if _, err := p.conn.Exec(ctx, query, args); err != nil {
+			return fmt.Errorf("error storing item %s: %w", guid, err)
+		}
+	}
+
+	return nil
+}
+
+// Identifies an item within its feed, falling back to the link or title when there is no guid
+func itemGUID(item *gofeed.Item) string {
+	switch {
+	case item.GUID != "":
+		return item.GUID
+	case item.Link != "":
+		return item.Link
+	default:
+		return item.Title
+	}
+}
+
+func itemAuthor(item *gofeed.Item) string {
+	if len(item.Authors) > 0 && item.Authors[0] != nil {
+		return item.Authors[0].Name
+	}
+	if item.Author != nil {
+		return item.Author.Name
+	}
+	return ""
+}
+
+func itemPublished(item *gofeed.Item) *time.Time {
+	if item.PublishedParsed != nil {
+		return item.PublishedParsed
+	}
+	return item.UpdatedParsed
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestPollFeedNotModified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != `"v1"` {
+			t.Errorf("Expected If-None-Match %q; got %q", `"v1"`, r.Header.Get("If-None-Match"))
+		}
+		if r.Header.Get("If-Modified-Since") != "Mon, 02 Jan 2006 15:04:05 GMT" {
+			t.Errorf("Unexpected If-Modified-Since %q", r.Header.Get("If-Modified-Since"))
+		}
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectExec(regexp.QuoteMeta("UPDATE feeds SET last_checked = now() WHERE id = $1")).
+		WithArgs(1).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	poller := NewPoller(mockPool, server.Client(), time.Minute, time.Hour)
+
+	feed := feedRow{
+		Id:           1,
+		Url:          server.URL,
+		ETag:         `"v1"`,
+		LastModified: "Mon, 02 Jan 2006 15:04:05 GMT",
+	}
+	if err := poller.pollFeed(context.Background(), feed); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A feed that never ends is refused once it passes the size limit
+func TestPollFeedTooLarge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<rss><channel>"))
+		chunk := []byte(strings.Repeat("<item></item>", 1024))
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	poller := NewPoller(mockPool, server.Client(), time.Minute, time.Hour)
+	err = poller.pollFeed(context.Background(), feedRow{Id: 1, Url: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("Expected a size error; got %v", err)
+	}
+}
+
+func TestStoreItemsKeepsOldItemsWithoutRetention(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	old := time.Now().AddDate(-5, 0, 0)
+	items := []*gofeed.Item{{GUID: "old", Title: "Old", PublishedParsed: &old}}
+
+	// With retention set the item is skipped
+	poller := NewPoller(mockPool, http.DefaultClient, time.Minute, 24*time.Hour)
+	if err := poller.storeItems(context.Background(), 1, items, poller.defaultCutoff()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Without it the item is stored
+	mockPool.ExpectExec("INSERT INTO items").
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(),
+			pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	poller = NewPoller(mockPool, http.DefaultClient, time.Minute, 0)
+	if err := poller.storeItems(context.Background(), 1, items, poller.defaultCutoff()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// Buckets idle for this long are full again and can be dropped
+	rateLimitIdleTTL      = time.Hour
+	rateLimitSweepEvery   = 10 * time.Minute
+	maxRateLimitBodyBytes = 1 << 16
+)
+
+// Failed logins before an account is locked, and how long the lock lasts. Each
+// further failure doubles the lock, up to the maximum.
+const (
+	loginLockoutThreshold = 5
+	loginLockoutBase      = time.Minute
+	loginLockoutMax       = time.Hour
+	// Failures with no further attempt for this long are forgotten
+	loginFailureTTL = 24 * time.Hour
+)
+
+// A token bucket holding up to Burst tokens, refilled at Burst per Period
+type RateLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+func (l RateLimit) perSecond() float64 {
+	return float64(l.Burst) / l.Period.Seconds()
+}
+
+var (
+	loginIPLimit      = RateLimit{Burst: 20, Period: time.Minute}
+	loginAccountLimit = RateLimit{Burst: 10, Period: 15 * time.Minute}
+	registerIPLimit   = RateLimit{Burst: 5, Period: time.Hour}
+	// Each password reset request can send an email
+	passwordResetIPLimit      = RateLimit{Burst: 5, Period: time.Hour}
+	passwordResetAccountLimit = RateLimit{Burst: 3, Period: time.Hour}
+)
+
+// Stores rate limit buckets. Take removes a token from the key's bucket and
+// reports whether one was available, and if not how long until one will be.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error)
+}
+
+// Creates the store selected by RATE_LIMIT_STORE:
+//
+//	memory    buckets are kept in process (default)
+//	postgres  buckets are kept in the rate_limits table and shared between instances
+func newRateLimitStoreFromEnv(ctx context.Context, conn PgxInterface) (RateLimitStore, error) {
+	switch os.Getenv("RATE_LIMIT_STORE") {
+	case "", "memory":
+		return newMemoryRateLimitStore(), nil
+
+	case "postgres":
+		store := &postgresRateLimitStore{conn: conn}
+		go store.sweep(ctx)
+		return store, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown RATE_LIMIT_STORE %q", os.Getenv("RATE_LIMIT_STORE"))
+	}
+}
+
+// Time until a bucket holding tokens has a whole token again
+func retryAfter(tokens float64, limit RateLimit) time.Duration {
+	return time.Duration((1 - tokens) / limit.perSecond() * float64(time.Second))
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*bucket{}, lastSweep: time.Now(), now: time.Now}
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) > rateLimitSweepEvery {
+		for k, b := range s.buckets {
+			if now.Sub(b.updated) > rateLimitIdleTTL {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.perSecond())
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, retryAfter(b.tokens, limit), nil
+	}
+
+	b.tokens--
+	return true, 0, nil
+}
+
+type postgresRateLimitStore struct {
+	conn PgxInterface
+}
+
+// Refills and takes from the bucket in one statement. A request that finds the
+// bucket empty still takes from it, down to -1, so retrying early pushes the
+// next allowed request back.
+func (s *postgresRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	query := `
+    INSERT INTO rate_limits (key, tokens, updated_at)
+    VALUES ($1, $2::float8 - 1, now())
+    ON CONFLICT (key) DO UPDATE SET
+        tokens = GREATEST(
+            LEAST($2::float8, rate_limits.tokens + EXTRACT(EPOCH FROM now() - rate_limits.updated_at) * $3::float8) - 1,
+            -1
+        ),
+        updated_at = now()
+    RETURNING tokens
+    `
+	var tokens float64
+	if err := s.conn.QueryRow(ctx, query, key, float64(limit.Burst), limit.perSecond()).Scan(&tokens); err != nil {
+		return false, 0, err
+	}
+
+	if tokens < 0 {
+		return false, retryAfter(tokens, limit), nil
+	}
+	return true, 0, nil
+}
+
+// Deletes idle buckets until ctx is cancelled
+func (s *postgresRateLimitStore) sweep(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.conn.Exec(ctx, "DELETE FROM rate_limits WHERE updated_at < $1", time.Now().Add(-rateLimitIdleTTL)); err != nil {
+				log.Printf("Error purging rate limits: %v", err)
+			}
+		}
+	}
+}
+
+// Returns the rate limit key for a request, or "" to skip the limit
+type rateLimitKeyFunc func(r *http.Request) string
+
+// Limits by client IP, separately for each path
+func byIP(r *http.Request) string {
+	return "ip:" + r.URL.Path + ":" + clientIP(r)
+}
+
+// Limits by the email in the JSON body, so attempts on one account are limited
+// however many addresses they come from. The body is restored for the handler.
+func byAccount(r *http.Request) string {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRateLimitBodyBytes))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var input struct {
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal(body, &input); err != nil || input.Email == "" {
+		return ""
+	}
+
+	return "account:" + r.URL.Path + ":" + strings.ToLower(strings.TrimSpace(input.Email))
+}
+
+// Writes a 429 response telling the client when to retry
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// Middleware that rejects requests with 429 once the key's bucket is empty. Does
+// nothing if the handler has no rate limit store.
+func (h *Handler) rateLimitMiddleware(limit RateLimit, key rateLimitKeyFunc, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.rateLimits == nil || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		k := key(r)
+		if k == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, wait, err := h.rateLimits.Take(r.Context(), k, limit)
+		if err != nil {
+			// Fail open rather than locking everyone out when the store is down
+			log.Printf("Error checking rate limit: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !allowed {
+			writeTooManyRequests(w, wait)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns how long logins for an email are locked for, or 0 if they aren't
+func (h *Handler) loginLockout(ctx context.Context, email string) (time.Duration, error) {
+	var lockedUntil *time.Time
+	err := h.conn.QueryRow(ctx, "SELECT locked_until FROM login_failures WHERE email = $1", email).Scan(&lockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if lockedUntil == nil {
+		return 0, nil
+	}
+	return max(time.Until(*lockedUntil), 0), nil
+}
+
+// Number of failures for an email once the current one is counted. Earlier
+// failures that have gone stale are forgotten.
+const loginFailureCount = `CASE WHEN f.last_failed_at < now() - make_interval(secs => $5::float8) THEN 1 ELSE f.failed_logins + 1 END`
+
+// Records a failed login, locking the email once failures reach the threshold.
+// Emails with no account are counted too, so a lockout doesn't reveal which
+// ones are registered.
+func (h *Handler) recordLoginFailure(ctx context.Context, email string) error {
+	query := `
+    INSERT INTO login_failures AS f (email, failed_logins, locked_until)
+    VALUES (
+        $1,
+        1,
+        CASE WHEN 1 >= $2 THEN now() + make_interval(secs => LEAST($3::float8 * power(2, 1 - $2), $4::float8)) END
+    )
+    ON CONFLICT (email) DO UPDATE
+    SET failed_logins = ` + loginFailureCount + `,
+        locked_until = CASE
+            WHEN ` + loginFailureCount + ` >= $2
+            THEN now() + make_interval(secs => LEAST($3::float8 * power(2, ` + loginFailureCount + ` - $2), $4::float8))
+        END,
+        last_failed_at = now()
+    `
+	_, err := h.conn.Exec(
+		ctx, query,
+		email, loginLockoutThreshold, loginLockoutBase.Seconds(), loginLockoutMax.Seconds(), loginFailureTTL.Seconds(),
+	)
+	return err
+}
+
+// Deletes stale failed logins until ctx is cancelled
+func (h *Handler) sweepLoginFailures(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := h.conn.Exec(ctx, "DELETE FROM login_failures WHERE last_failed_at < $1", time.Now().Add(-loginFailureTTL)); err != nil {
+				log.Printf("Error purging failed logins: %v", err)
+			}
+		}
+	}
+}
+
+// Clears failed logins once a login has fully succeeded
+func (h *Handler) resetLoginFailures(ctx context.Context, email string) error {
+	_, err := h.conn.Exec(ctx, "DELETE FROM login_failures WHERE email = $1", email)
+	return err
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Now()
+	store := newMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+
+	limit := RateLimit{Burst: 2, Period: time.Minute}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if allowed, _, _ := store.Take(ctx, "key", limit); !allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	allowed, wait, _ := store.Take(ctx, "key", limit)
+	if allowed {
+		t.Fatal("Expected request over the burst to be refused")
+	}
+	if wait <= 0 || wait > 30*time.Second {
+		t.Errorf("Expected a wait of up to 30s; got %v", wait)
+	}
+
+	// Other keys have their own bucket
+	if allowed, _, _ := store.Take(ctx, "other", limit); !allowed {
+		t.Error("Expected a different key to be allowed")
+	}
+
+	// One token is refilled every 30s
+	now = now.Add(30 * time.Second)
+	if allowed, _, _ := store.Take(ctx, "key", limit); !allowed {
+		t.Error("Expected request after refill to be allowed")
+	}
+}
+
+func TestPostgresRateLimitStore(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	limit := RateLimit{Burst: 10, Period: 10 * time.Second}
+
+	mockPool.ExpectQuery("INSERT INTO rate_limits").
+		WithArgs("key", 10.0, 1.0).
+		WillReturnRows(pgxmock.NewRows([]string{"tokens"}).AddRow(-0.5))
+
+	store := &postgresRateLimitStore{conn: mockPool}
+	allowed, wait, err := store.Take(context.Background(), "key", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed {
+		t.Error("Expected request to be refused")
+	}
+	if wait != 1500*time.Millisecond {
+		t.Errorf("Expected wait of 1.5s; got %v", wait)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	handler := &Handler{rateLimits: newMemoryRateLimitStore()}
+	limit := RateLimit{Burst: 1, Period: time.Minute}
+
+	var body string
+	next := handler.rateLimitMiddleware(limit, byAccount, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	})
+
+	input := `{"email":"Test@Email.com","password":"password"}`
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(input))
+	w := httptest.NewRecorder()
+	next.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d; got %d", http.StatusOK, w.Code)
+	}
+	if body != input {
+		t.Errorf("Expected the handler to get the request body; got %q", body)
+	}
+
+	// Same account with different case from another address
+	req = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email":"test@email.com"}`))
+	req.RemoteAddr = "192.0.2.2:1234"
+	w = httptest.NewRecorder()
+	next.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d; got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "60" {
+		t.Errorf("Expected Retry-After 60; got %q", retry)
+	}
+}
+
+func TestHandleLoginLockedAccount(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	// Locked emails are refused before looking for an account, so it's the
+	// same whether or not one exists
+	lockedUntil := time.Now().Add(time.Minute)
+	mockPool.ExpectQuery("SELECT locked_until FROM login_failures").
+		WithArgs("test@email.com").
+		WillReturnRows(pgxmock.NewRows([]string{"locked_until"}).AddRow(&lockedUntil))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email":"test@email.com","password":"password"}`))
+	w := httptest.NewRecorder()
+	handler.handleLogin(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d; got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleLoginUnknownEmail(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("SELECT locked_until FROM login_failures").
+		WithArgs("nobody@email.com").
+		WillReturnRows(pgxmock.NewRows([]string{"locked_until"}))
+	mockPool.ExpectQuery("SELECT id, username, email, password, role, (.+) FROM users").
+		WithArgs("nobody@email.com").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "password", "role", "disabled"}))
+	// Unknown emails count toward a lockout like registered ones
+	mockPool.ExpectExec("INSERT INTO login_failures").
+		WithArgs("nobody@email.com", pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email":"nobody@email.com","password":"password"}`))
+	w := httptest.NewRecorder()
+	handler.handleLogin(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d; got %d", http.StatusUnauthorized, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleLoginTwoFactorKeepsFailures(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The right password on a 2FA account doesn't clear earlier failures
+	mockPool.ExpectQuery("SELECT locked_until FROM login_failures").
+		WithArgs("test@email.com").
+		WillReturnRows(pgxmock.NewRows([]string{"locked_until"}))
+	mockPool.ExpectQuery("SELECT id, username, email, password, role, (.+) FROM users").
+		WithArgs("test@email.com").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "password", "role", "disabled"}).
+			AddRow("u1", "user", "test@email.com", string(hash), RoleUser, false))
+	mockPool.ExpectQuery("SELECT EXISTS").
+		WithArgs("u1").
+		WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+	mockPool.ExpectExec("INSERT INTO login_challenges").
+		WithArgs(pgxmock.AnyArg(), "u1", pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email":"test@email.com","password":"password"}`))
+	w := httptest.NewRecorder()
+	handler.handleLogin(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d; got %d", http.StatusOK, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A lockout that can't be read refuses the login rather than skipping the check
+func TestLoginLockoutDBError(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("SELECT locked_until FROM login_failures").
+		WithArgs("test@email.com").
+		WillReturnError(errors.New("connection refused"))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"email":"test@email.com","password":"password"}`))
+	w := httptest.NewRecorder()
+	handler.handleLogin(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d; got %d", http.StatusInternalServerError, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Registering an email that already has an account looks the same as a new
+// registration, and the owner is emailed instead
+func TestHandleRegisterExistingEmail(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("SELECT id, username, email FROM users").
+		WithArgs("test@email.com").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email"}).AddRow("u1", "user", "test@email.com"))
+
+	mailer := chanMailer(make(chan Mail, 1))
+	handler := &Handler{conn: mockPool, mailer: mailer}
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"username":"other","email":"test@email.com","password":"password"}`))
+	w := httptest.NewRecorder()
+	handler.handleRegisterUser(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected status %d; got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected an empty body; got %q", w.Body.String())
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// The notice is sent in the background
+	select {
+	case mail := <-mailer:
+		if mail.To != "test@email.com" || !strings.Contains(mail.Body, "already has one") {
+			t.Errorf("Expected a notice to the existing owner; got %+v", mail)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected an email to the existing owner")
+	}
+}
+
+// Passes sent mail to the test
+type chanMailer chan Mail
+
+func (m chanMailer) Send(ctx context.Context, mail Mail) error {
+	m <- mail
+	return nil
+}
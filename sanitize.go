@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Allowed tags and the attributes allowed on each. Other tags are removed but
+// their contents are kept.
+var allowedTags = map[string][]string{
+	"a":          {"href", "title"},
+	"abbr":       {"title"},
+	"b":          nil,
+	"blockquote": {"cite"},
+	"br":         nil,
+	"caption":    nil,
+	"cite":       nil,
+	"code":       nil,
+	"dd":         nil,
+	"del":        nil,
+	"div":        nil,
+	"dl":         nil,
+	"dt":         nil,
+	"em":         nil,
+	"figcaption": nil,
+	"figure":     nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"hr":         nil,
+	"i":          nil,
+	"img":        {"src", "alt", "title", "width", "height"},
+	"ins":        nil,
+	"kbd":        nil,
+	"li":         nil,
+	"mark":       nil,
+	"ol":         nil,
+	"p":          nil,
+	"pre":        nil,
+	"q":          {"cite"},
+	"s":          nil,
+	"small":      nil,
+	"span":       nil,
+	"strong":     nil,
+	"sub":        nil,
+	"sup":        nil,
+	"table":      nil,
+	"tbody":      nil,
+	"td":         {"colspan", "rowspan"},
+	"tfoot":      nil,
+	"th":         {"colspan", "rowspan", "scope"},
+	"thead":      nil,
+	"tr":         nil,
+	"u":          nil,
+	"ul":         nil,
+}
+
+// Tags removed along with everything inside them
+var droppedTags = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"iframe":   true,
+	"frame":    true,
+	"frameset": true,
+	"object":   true,
+	"embed":    true,
+	"applet":   true,
+	"noscript": true,
+	"template": true,
+	"form":     true,
+	"textarea": true,
+	"select":   true,
+	"button":   true,
+	"svg":      true,
+	"math":     true,
+	"head":     true,
+	"title":    true,
+	"meta":     true,
+	"link":     true,
+	"base":     true,
+}
+
+var voidTags = map[string]bool{
+	"br":  true,
+	"hr":  true,
+	"img": true,
+}
+
+// Attributes holding URLs, which are resolved and checked against allowedSchemes
+var urlAttrs = map[string]bool{
+	"href": true,
+	"src":  true,
+	"cite": true,
+}
+
+var allowedSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+}
+
+// Sanitizes feed item HTML: only allowlisted tags and attributes are kept,
+// scripts, styles and event handlers are removed, and URLs are resolved
+// against base with anything other than http(s) or mailto dropped.
+func sanitizeHTML(input string, base string) string {
+	if input == "" {
+		return ""
+	}
+
+	baseURL, err := url.Parse(base)
+	if err != nil || !baseURL.IsAbs() {
+		baseURL = nil
+	}
+
+	parent := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(input), parent)
+	if err != nil {
+		return html.EscapeString(input)
+	}
+
+	var b strings.Builder
+	for _, n := range nodes {
+		writeSanitized(&b, n, baseURL)
+	}
+
+	return b.String()
+}
+
+func writeSanitized(b *strings.Builder, n *html.Node, base *url.URL) {
+	switch n.Type {
+	case html.TextNode:
+		b.WriteString(html.EscapeString(n.Data))
+		return
+
+	case html.ElementNode:
+		tag := strings.ToLower(n.Data)
+		if droppedTags[tag] {
+			return
+		}
+
+		attrs, ok := allowedTags[tag]
+		if !ok {
+			// Unwrap unknown tags
+			writeSanitizedChildren(b, n, base)
+			return
+		}
+
+		b.WriteString("<" + tag)
+		for _, attr := range n.Attr {
+			if attr.Namespace != "" || !slices.Contains(attrs, strings.ToLower(attr.Key)) {
+				continue
+			}
+
+			key := strings.ToLower(attr.Key)
+			value := attr.Val
+			if urlAttrs[key] {
+				value = sanitizeURL(value, base)
+				if value == "" {
+					continue
+				}
+			}
+
+			b.WriteString(" " + key + `="` + html.EscapeString(value) + `"`)
+		}
+		if tag == "a" {
+			b.WriteString(` rel="nofollow noopener noreferrer"`)
+		}
+		b.WriteString(">")
+
+		if voidTags[tag] {
+			return
+		}
+
+		writeSanitizedChildren(b, n, base)
+		b.WriteString("</" + tag + ">")
+
+	case html.DocumentNode:
+		writeSanitizedChildren(b, n, base)
+	}
+
+	// Comments, doctypes and other nodes are dropped
+}
+
+func writeSanitizedChildren(b *strings.Builder, n *html.Node, base *url.URL) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		writeSanitized(b, c, base)
+	}
+}
+
+// Resolves a URL against base and returns it if its scheme is allowed, or "" otherwise
+func sanitizeURL(value string, base *url.URL) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return ""
+	}
+
+	// Keep in-page fragment links as they are
+	if !u.IsAbs() && u.Host == "" && u.Path == "" && u.RawQuery == "" {
+		return value
+	}
+
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+
+	if !u.IsAbs() || !allowedSchemes[strings.ToLower(u.Scheme)] {
+		return ""
+	}
+
+	return u.String()
+}
+
+// Returns link if it is an absolute http(s) URL, or "" otherwise
+func sanitizeLink(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+// Sanitizes an item's HTML fields, resolving relative URLs against the item's link
+func (item *FeedItem) sanitize(link string) {
+	item.Content = sanitizeHTML(item.Content, link)
+	item.Description = sanitizeHTML(item.Description, link)
+}
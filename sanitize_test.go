@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestSanitizeHTML(t *testing.T) {
+	base := "https://example.com/posts/1"
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain text", "Hello & goodbye", "Hello &amp; goodbye"},
+		{"allowed tags", "<p>Hi <strong>there</strong></p>", "<p>Hi <strong>there</strong></p>"},
+		{"script removed", `<p>a</p><script>alert(1)</script>`, "<p>a</p>"},
+		{"event handler removed", `<img src="/a.png" onerror="alert(1)">`, `<img src="https://example.com/a.png">`},
+		{"javascript url removed", `<a href="javascript:alert(1)">x</a>`, `<a rel="nofollow noopener noreferrer">x</a>`},
+		{"obfuscated javascript url removed", `<a href=" JaVaScRiPt:alert(1)">x</a>`, `<a rel="nofollow noopener noreferrer">x</a>`},
+		{"relative link resolved", `<a href="../2">next</a>`, `<a href="https://example.com/2" rel="nofollow noopener noreferrer">next</a>`},
+		{"unknown tag unwrapped", `<custom>text</custom>`, "text"},
+		{"style attribute removed", `<span style="position:fixed">x</span>`, "<span>x</span>"},
+		{"iframe removed", `<iframe src="https://evil.example"></iframe>ok`, "ok"},
+		{"comment removed", `a<!-- <script> -->b`, "ab"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeHTML(tt.input, base); got != tt.want {
+				t.Errorf("sanitizeHTML(%q) = %q; want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
@@ -26,10 +26,18 @@ type PgxInterface interface {
 	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
 	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
 	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
 }
 
 type Handler struct {
-	conn PgxInterface
+	conn   PgxInterface
+	client *http.Client
+	poller *Poller
+	mailer Mailer
+	oidc   *OIDCProvider
+	keys   *KeySet
+	// Rate limiting is skipped if nil
+	rateLimits RateLimitStore
 }
 
 func SetupRouter(h *Handler) *mux.Router {
@@ -40,43 +48,201 @@ func SetupRouter(h *Handler) *mux.Router {
 	root := r.HandleFunc("/", corsMiddleware(h.handleRoot))
 	root.Methods(http.MethodGet)
 
-	registerUser := r.HandleFunc("/register", corsMiddleware(h.handleRegisterUser))
+	jwks := r.HandleFunc("/.well-known/jwks.json", corsMiddleware(h.handleJWKS))
+	jwks.Methods(http.MethodGet, http.MethodOptions)
+
+	registerUser := r.HandleFunc("/register", corsMiddleware(h.rateLimitMiddleware(registerIPLimit, byIP, h.handleRegisterUser)))
 	registerUser.Methods(http.MethodPost, http.MethodOptions)
 
-	deleteUser := r.HandleFunc("/delete-user", corsMiddleware(authMiddleware(h.handleDeleteUser)))
+	deleteUser := r.HandleFunc("/delete-user", corsMiddleware(h.authMiddleware(requireSession(h.handleDeleteUser))))
 	deleteUser.Methods(http.MethodDelete, http.MethodOptions)
 
-	login := r.HandleFunc("/login", corsMiddleware(h.handleLogin))
+	login := r.HandleFunc("/login", corsMiddleware(
+		h.rateLimitMiddleware(loginIPLimit, byIP, h.rateLimitMiddleware(loginAccountLimit, byAccount, h.handleLogin)),
+	))
 	login.Methods(http.MethodPost, http.MethodOptions)
 
+	refreshToken := r.HandleFunc("/token/refresh", corsMiddleware(h.handleRefreshToken))
+	refreshToken.Methods(http.MethodPost, http.MethodOptions)
+
+	logout := r.HandleFunc("/logout", corsMiddleware(h.handleLogout))
+	logout.Methods(http.MethodPost, http.MethodOptions)
+
+	loginTwoFactor := r.HandleFunc("/login/2fa", corsMiddleware(h.rateLimitMiddleware(loginIPLimit, byIP, h.handleLoginTwoFactor)))
+	loginTwoFactor.Methods(http.MethodPost, http.MethodOptions)
+
+	// Each login stores a state, so they're limited like password logins
+	oidcLogin := r.HandleFunc("/oidc/login", corsMiddleware(h.rateLimitMiddleware(loginIPLimit, byIP, h.handleOIDCLogin)))
+	oidcLogin.Methods(http.MethodGet, http.MethodOptions)
+
+	oidcCallback := r.HandleFunc("/oidc/callback", corsMiddleware(h.handleOIDCCallback))
+	oidcCallback.Methods(http.MethodGet, http.MethodOptions)
+
+	forgotPassword := r.HandleFunc("/forgot-password", corsMiddleware(
+		h.rateLimitMiddleware(passwordResetIPLimit, byIP, h.rateLimitMiddleware(passwordResetAccountLimit, byAccount, h.handleForgotPassword)),
+	))
+	forgotPassword.Methods(http.MethodPost, http.MethodOptions)
+
+	resetPassword := r.HandleFunc("/reset-password", corsMiddleware(h.handleResetPassword))
+	resetPassword.Methods(http.MethodPost, http.MethodOptions)
+
+	verifyEmail := r.HandleFunc("/verify-email", corsMiddleware(h.handleVerifyEmail))
+	verifyEmail.Methods(http.MethodPost, http.MethodOptions)
+
+	resendVerification := r.HandleFunc("/resend-verification", corsMiddleware(h.authMiddleware(requireSession(h.handleResendVerification))))
+	resendVerification.Methods(http.MethodPost, http.MethodOptions)
+
+	/* ACCOUNT */
+
+	changePassword := r.HandleFunc("/account/password", corsMiddleware(h.authMiddleware(requireSession(h.handleChangePassword))))
+	changePassword.Methods(http.MethodPost, http.MethodOptions)
+
+	changeEmail := r.HandleFunc("/account/email", corsMiddleware(h.authMiddleware(requireSession(h.handleChangeEmail))))
+	changeEmail.Methods(http.MethodPost, http.MethodOptions)
+
+	changeUsername := r.HandleFunc("/account/username", corsMiddleware(h.authMiddleware(requireSession(h.handleChangeUsername))))
+	changeUsername.Methods(http.MethodPost, http.MethodOptions)
+
+	createDataExport := r.HandleFunc("/account/export", corsMiddleware(h.authMiddleware(requireSession(h.handleCreateDataExport))))
+	createDataExport.Methods(http.MethodPost, http.MethodOptions)
+
+	getDataExport := r.HandleFunc("/account/export/{exportId}", corsMiddleware(h.authMiddleware(requireSession(h.handleGetDataExport))))
+	getDataExport.Methods(http.MethodGet, http.MethodOptions)
+
+	downloadDataExport := r.HandleFunc("/account/export/{exportId}/download", corsMiddleware(h.authMiddleware(requireSession(h.handleDownloadDataExport))))
+	downloadDataExport.Methods(http.MethodGet, http.MethodOptions)
+
+	/* TWO-FACTOR AUTHENTICATION */
+
+	enrollTOTP := r.HandleFunc("/2fa/enroll", corsMiddleware(h.authMiddleware(requireSession(h.handleEnrollTOTP))))
+	enrollTOTP.Methods(http.MethodPost, http.MethodOptions)
+
+	confirmTOTP := r.HandleFunc("/2fa/confirm", corsMiddleware(h.authMiddleware(requireSession(h.handleConfirmTOTP))))
+	confirmTOTP.Methods(http.MethodPost, http.MethodOptions)
+
+	disableTOTP := r.HandleFunc("/2fa/disable", corsMiddleware(h.authMiddleware(requireSession(h.handleDisableTOTP))))
+	disableTOTP.Methods(http.MethodPost, http.MethodOptions)
+
+	regenerateRecoveryCodes := r.HandleFunc("/2fa/recovery-codes", corsMiddleware(h.authMiddleware(requireSession(h.handleRegenerateRecoveryCodes))))
+	regenerateRecoveryCodes.Methods(http.MethodPost, http.MethodOptions)
+
+	/* SESSIONS */
+
+	getSessions := r.HandleFunc("/sessions", corsMiddleware(h.authMiddleware(requireSession(h.handleGetSessions))))
+	getSessions.Methods(http.MethodGet, http.MethodOptions)
+
+	revokeAllSessions := r.HandleFunc("/sessions", corsMiddleware(h.authMiddleware(requireSession(h.handleRevokeAllSessions))))
+	revokeAllSessions.Methods(http.MethodDelete, http.MethodOptions)
+
+	revokeSession := r.HandleFunc("/sessions/{sessionId}", corsMiddleware(h.authMiddleware(requireSession(h.handleRevokeSession))))
+	revokeSession.Methods(http.MethodDelete, http.MethodOptions)
+
+	/* ADMIN */
+
+	adminGetUsers := r.HandleFunc("/admin/users", corsMiddleware(h.authMiddleware(requireSession(adminMiddleware(h.handleAdminGetUsers)))))
+	adminGetUsers.Methods(http.MethodGet, http.MethodOptions)
+
+	adminDisableUser := r.HandleFunc("/admin/users/{userId}/disable", corsMiddleware(h.authMiddleware(requireSession(adminMiddleware(h.handleAdminDisableUser)))))
+	adminDisableUser.Methods(http.MethodPost, http.MethodOptions)
+
+	adminEnableUser := r.HandleFunc("/admin/users/{userId}/enable", corsMiddleware(h.authMiddleware(requireSession(adminMiddleware(h.handleAdminEnableUser)))))
+	adminEnableUser.Methods(http.MethodPost, http.MethodOptions)
+
+	adminForcePasswordReset := r.HandleFunc("/admin/users/{userId}/force-password-reset", corsMiddleware(h.authMiddleware(requireSession(adminMiddleware(h.handleAdminForcePasswordReset)))))
+	adminForcePasswordReset.Methods(http.MethodPost, http.MethodOptions)
+
+	adminDeleteUser := r.HandleFunc("/admin/users/{userId}", corsMiddleware(h.authMiddleware(requireSession(adminMiddleware(h.handleAdminDeleteUser)))))
+	adminDeleteUser.Methods(http.MethodDelete, http.MethodOptions)
+
+	/* API KEYS */
+
+	createAPIKey := r.HandleFunc("/api-keys", corsMiddleware(h.authMiddleware(requireSession(h.handleCreateAPIKey))))
+	createAPIKey.Methods(http.MethodPost, http.MethodOptions)
+
+	getAPIKeys := r.HandleFunc("/api-keys", corsMiddleware(h.authMiddleware(requireSession(h.handleGetAPIKeys))))
+	getAPIKeys.Methods(http.MethodGet, http.MethodOptions)
+
+	revokeAPIKey := r.HandleFunc("/api-keys/{keyId}", corsMiddleware(h.authMiddleware(requireSession(h.handleRevokeAPIKey))))
+	revokeAPIKey.Methods(http.MethodDelete, http.MethodOptions)
+
 	/* FOLDERS */
 
-	createUserFolder := r.HandleFunc("/user-folders", corsMiddleware(authMiddleware(h.handleCreateUserFolder)))
+	createUserFolder := r.HandleFunc("/user-folders", corsMiddleware(h.authMiddleware(h.handleCreateUserFolder)))
 	createUserFolder.Methods(http.MethodPost, http.MethodOptions)
 
-	getUserFolders := r.HandleFunc("/user-folders", corsMiddleware(authMiddleware(h.handleGetUserFolders)))
+	getUserFolders := r.HandleFunc("/user-folders", corsMiddleware(h.authMiddleware(h.handleGetUserFolders)))
 	getUserFolders.Methods(http.MethodGet, http.MethodOptions)
 
-	getFolderSubscriptions := r.HandleFunc("/folders/{folderId}/subscriptions", corsMiddleware(authMiddleware(h.handleGetFolderSubscriptions)))
+	reorderFolders := r.HandleFunc("/folders/reorder", corsMiddleware(h.authMiddleware(h.handleReorderFolders)))
+	reorderFolders.Methods(http.MethodPost, http.MethodOptions)
+
+	renameFolder := r.HandleFunc("/folders/{folderId}", corsMiddleware(h.authMiddleware(h.handleRenameFolder)))
+	renameFolder.Methods(http.MethodPut, http.MethodOptions)
+
+	deleteFolder := r.HandleFunc("/folders/{folderId}", corsMiddleware(h.authMiddleware(h.handleDeleteFolder)))
+	deleteFolder.Methods(http.MethodDelete, http.MethodOptions)
+
+	moveFolder := r.HandleFunc("/folders/{folderId}/move", corsMiddleware(h.authMiddleware(h.handleMoveFolder)))
+	moveFolder.Methods(http.MethodPost, http.MethodOptions)
+
+	getFolderSubscriptions := r.HandleFunc("/folders/{folderId}/subscriptions", corsMiddleware(h.authMiddleware(h.handleGetFolderSubscriptions)))
 	getFolderSubscriptions.Methods(http.MethodGet, http.MethodOptions)
 
+	markFolderRead := r.HandleFunc("/folders/{folderId}/mark-read", corsMiddleware(h.authMiddleware(h.handleMarkFolderRead)))
+	markFolderRead.Methods(http.MethodPost, http.MethodOptions)
+
 	/* SUBSCRIPTIONS & FEEDS */
 
-	usersubscriptions := r.HandleFunc("/user-subscriptions", corsMiddleware(authMiddleware(h.handleGetUserSubscriptions)))
+	usersubscriptions := r.HandleFunc("/user-subscriptions", corsMiddleware(h.authMiddleware(h.handleGetUserSubscriptions)))
 	usersubscriptions.Methods(http.MethodGet, http.MethodOptions)
 
-	searchSubscription := r.HandleFunc("/search-subscription", corsMiddleware(authMiddleware(h.handleSearchSubscription)))
+	searchSubscription := r.HandleFunc("/search-subscription", corsMiddleware(h.authMiddleware(h.handleSearchSubscription)))
 	searchSubscription.Methods(http.MethodGet, http.MethodOptions)
 
-	addSubscription := r.HandleFunc("/add-subscriptions", corsMiddleware(authMiddleware(h.handleAddSubscriptions)))
+	addSubscription := r.HandleFunc("/add-subscriptions", corsMiddleware(h.authMiddleware(h.handleAddSubscriptions)))
 	addSubscription.Methods(http.MethodPost, http.MethodOptions)
 
-	deleteSubscriptions := r.HandleFunc("/delete-subscriptions", corsMiddleware(authMiddleware(h.handleDeleteSubscriptions)))
+	moveSubscriptions := r.HandleFunc("/subscriptions/move", corsMiddleware(h.authMiddleware(h.handleMoveSubscriptions)))
+	moveSubscriptions.Methods(http.MethodPost, http.MethodOptions)
+
+	deleteSubscriptions := r.HandleFunc("/delete-subscriptions", corsMiddleware(h.authMiddleware(h.handleDeleteSubscriptions)))
 	deleteSubscriptions.Methods(http.MethodDelete, http.MethodOptions)
 
-	fetchFeed := r.HandleFunc("/fetch-feed", corsMiddleware(authMiddleware(h.handleFetchFeed)))
+	fetchFeed := r.HandleFunc("/fetch-feed", corsMiddleware(h.authMiddleware(h.handleFetchFeed)))
 	fetchFeed.Methods(http.MethodGet, http.MethodOptions)
 
+	updateSubscription := r.HandleFunc("/subscriptions/{subscriptionId}", corsMiddleware(h.authMiddleware(h.handleUpdateSubscription)))
+	updateSubscription.Methods(http.MethodPut, http.MethodOptions)
+
+	markSubscriptionRead := r.HandleFunc("/subscriptions/{subscriptionId}/mark-read", corsMiddleware(h.authMiddleware(h.handleMarkSubscriptionRead)))
+	markSubscriptionRead.Methods(http.MethodPost, http.MethodOptions)
+
+	importOPML := r.HandleFunc("/import-opml", corsMiddleware(h.authMiddleware(h.handleImportOPML)))
+	importOPML.Methods(http.MethodPost, http.MethodOptions)
+
+	exportOPML := r.HandleFunc("/export-opml", corsMiddleware(h.authMiddleware(h.handleExportOPML)))
+	exportOPML.Methods(http.MethodGet, http.MethodOptions)
+
+	/* ITEMS */
+
+	getItems := r.HandleFunc("/items", corsMiddleware(h.authMiddleware(h.handleGetItems)))
+	getItems.Methods(http.MethodGet, http.MethodOptions)
+
+	setItemRead := r.HandleFunc("/items/{itemId}/read", corsMiddleware(h.authMiddleware(h.handleSetItemRead)))
+	setItemRead.Methods(http.MethodPost, http.MethodDelete, http.MethodOptions)
+
+	markItemsRead := r.HandleFunc("/mark-items-read", corsMiddleware(h.authMiddleware(h.handleMarkItemsRead)))
+	markItemsRead.Methods(http.MethodPost, http.MethodOptions)
+
+	starItem := r.HandleFunc("/items/{itemId}/star", corsMiddleware(h.authMiddleware(h.handleStarItem)))
+	starItem.Methods(http.MethodPost, http.MethodOptions)
+
+	unstarItem := r.HandleFunc("/items/{itemId}/star", corsMiddleware(h.authMiddleware(h.handleUnstarItem)))
+	unstarItem.Methods(http.MethodDelete, http.MethodOptions)
+
+	starredItems := r.HandleFunc("/starred", corsMiddleware(h.authMiddleware(h.handleGetStarredItems)))
+	starredItems.Methods(http.MethodGet, http.MethodOptions)
+
 	return r
 }
 
@@ -92,11 +258,71 @@ func main() {
 	}
 	defer conn.Close()
 
+	// Client for all server-side fetches of user-supplied URLs
+	outboundConfig, err := loadOutboundConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	client := newOutboundClient(outboundConfig)
+
+	mailer, err := newMailerFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
+	// Access token signing keys
+	keys, err := loadKeySet()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
+	// OIDC login is enabled when OIDC_ISSUER is set
+	oidcConfig, err := loadOIDCConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	var oidcProvider *OIDCProvider
+	if oidcConfig != nil {
+		oidcProvider = NewOIDCProvider(*oidcConfig, nil)
+	}
+
+	// Start feed poller
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	poller := NewPoller(conn, client, getPollInterval(), getRetention())
+	go poller.Run(ctx)
+
+	rateLimits, err := newRateLimitStoreFromEnv(ctx, conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
 	// Init handler
 	handler := &Handler{
-		conn: conn,
+		conn:   conn,
+		client: client,
+		poller: poller,
+		mailer: mailer,
+		oidc:   oidcProvider,
+		keys:   keys,
+
+		rateLimits: rateLimits,
 	}
 
+	go handler.sweepLoginFailures(ctx)
+	if oidcProvider != nil {
+		go handler.sweepOIDCStates(ctx)
+	}
+
+	// Exports run in the background, so any in progress when a server stopped were lost
+	go handler.sweepInterruptedExports(ctx)
+
 	mux := SetupRouter(handler)
 	server := &http.Server{
 		Addr:    ":8080",
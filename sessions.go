@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var ErrSessionRevoked = errors.New("session has been revoked")
+
+type Session struct {
+	Id         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	Ip         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+// Checks that the token's session is active and updates its last seen time and IP
+func (h *Handler) touchSession(ctx context.Context, token *Token, ip string) error {
+	if token.SessionId == "" {
+		return ErrSessionRevoked
+	}
+
+	// Only writes the row when the last seen time is stale or the IP has changed,
+	// rather than on every request
+	query := `
+    WITH active AS (
+        SELECT id FROM sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+    ), touched AS (
+        UPDATE sessions SET last_seen_at = now(), ip = $3
+        WHERE id IN (SELECT id FROM active)
+            AND (last_seen_at < now() - interval '1 minute' OR ip <> $3)
+    )
+    SELECT EXISTS (SELECT 1 FROM active)
+    `
+	var active bool
+	if err := h.conn.QueryRow(ctx, query, token.SessionId, token.Id, ip).Scan(&active); err != nil {
+		return err
+	}
+	if !active {
+		return ErrSessionRevoked
+	}
+
+	return nil
+}
+
+// Revokes a session and its refresh tokens
+func (h *Handler) revokeSession(ctx context.Context, sessionID string) error {
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(
+		ctx,
+		"UPDATE sessions SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL",
+		sessionID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		ctx,
+		"UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL",
+		sessionID,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Revokes all of a user's sessions and their refresh tokens
+func (h *Handler) revokeUserSessions(ctx context.Context, userID string) error {
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(
+		ctx,
+		"UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL",
+		userID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		ctx,
+		"UPDATE refresh_tokens SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL",
+		userID,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Revokes all of a user's sessions except one, e.g. the one changing the password
+func (h *Handler) revokeOtherSessions(ctx context.Context, userID string, keepSessionID string) error {
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(
+		ctx,
+		"UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL",
+		userID, keepSessionID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		ctx,
+		"UPDATE refresh_tokens SET revoked_at = now() WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL",
+		userID, keepSessionID,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (h *Handler) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Sessions that haven't been revoked and can still be refreshed
+	query := `
+    SELECT s.id, s.user_agent, s.ip, s.created_at, s.last_seen_at
+    FROM sessions s
+    WHERE s.user_id = $1
+        AND s.revoked_at IS NULL
+        AND EXISTS (
+            SELECT 1 FROM refresh_tokens rt
+            WHERE rt.family_id = s.id AND rt.used_at IS NULL AND rt.revoked_at IS NULL AND rt.expires_at > now()
+        )
+    ORDER BY s.last_seen_at DESC
+    `
+	rows, err := h.conn.Query(context.Background(), query, userToken.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting sessions for user %s: %v", userToken.Id, err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(&session.Id, &session.UserAgent, &session.Ip, &session.CreatedAt, &session.LastSeenAt); err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning session row: %v", err), http.StatusInternalServerError)
+			return
+		}
+		session.Current = session.Id == userToken.SessionId
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error iterating over sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (h *Handler) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	sessionID := mux.Vars(r)["sessionId"]
+	if !validUUID(sessionID) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	// Check the session belongs to the user
+	var exists bool
+	if err := h.conn.QueryRow(
+		context.Background(),
+		"SELECT EXISTS(SELECT 1 FROM sessions WHERE id = $1 AND user_id = $2)",
+		sessionID, userToken.Id,
+	).Scan(&exists); err != nil {
+		http.Error(w, fmt.Sprintf("Error getting session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.revokeSession(context.Background(), sessionID); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking session: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) handleRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	if err := h.revokeUserSessions(context.Background(), userToken.Id); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
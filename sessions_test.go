@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestHandleRevokeSessionInvalidID(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodDelete, "/sessions/not-a-uuid", nil)
+	req = mux.SetURLVars(req, map[string]string{"sessionId": "not-a-uuid"})
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleRevokeSession(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d; got %d", http.StatusNotFound, w.Code)
+	}
+	// The id never reaches the database
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRevokeSessionRollsBack(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockPool.Close()
+
+	// The session must stay active if its refresh tokens can't be revoked
+	mockPool.ExpectBegin()
+	mockPool.ExpectExec("UPDATE sessions SET revoked_at").
+		WithArgs("s1").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mockPool.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+		WithArgs("s1").
+		WillReturnError(errors.New("connection lost"))
+	mockPool.ExpectRollback()
+
+	handler := &Handler{conn: mockPool}
+	if err := handler.revokeSession(context.Background(), "s1"); err == nil {
+		t.Error("Expected an error")
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestValidUUID(t *testing.T) {
+	tests := map[string]bool{
+		"6f1c2d3e-4a5b-6c7d-8e9f-0a1b2c3d4e5f": true,
+		"6F1C2D3E-4A5B-6C7D-8E9F-0A1B2C3D4E5F": true,
+		"6f1c2d3e4a5b6c7d8e9f0a1b2c3d4e5f":     false,
+		"6f1c2d3e-4a5b-6c7d-8e9f-0a1b2c3d4e5g": false,
+		"reorder":                              false,
+		"":                                     false,
+	}
+
+	for value, expected := range tests {
+		if got := validUUID(value); got != expected {
+			t.Errorf("validUUID(%q) = %v; expected %v", value, got, expected)
+		}
+	}
+}
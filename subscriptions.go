@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	DisplayModeFull    = "full"
+	DisplayModeSummary = "summary"
+	DisplayModeTitle   = "title"
+)
+
+var displayModes = []string{DisplayModeFull, DisplayModeSummary, DisplayModeTitle}
+
+// Upper limit on a subscription's retention override, in days
+const maxRetentionDays = 3650
+
+// Columns scanned by scanSubscription, for a query joining subscriptions s
+// to feeds f
+const subscriptionColumns = `s.id, COALESCE(s.title, f.title, ''), COALESCE(f.title, ''), f.url, f.last_checked,
+    s.folder_id, s.notify, s.display_mode, s.retention_days, ` + unreadCountQuery
+
+func scanSubscription(row pgx.Row) (UserSubscription, error) {
+	var sub UserSubscription
+	err := row.Scan(
+		&sub.Id, &sub.Title, &sub.FeedTitle, &sub.Url, &sub.LastChecked,
+		&sub.FolderId, &sub.Notify, &sub.DisplayMode, &sub.RetentionDays, &sub.UnreadCount,
+	)
+	return sub, err
+}
+
+type UpdateSubscriptionInput struct {
+	// Display title, or null to use the feed's title
+	Title         *string `json:"title"`
+	Notify        bool    `json:"notify"`
+	DisplayMode   string  `json:"display_mode"`
+	RetentionDays *int    `json:"retention_days"`
+}
+
+// Replaces a subscription's title and settings. Omitted fields are reset to
+// their defaults.
+func (h *Handler) handleUpdateSubscription(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	subscriptionID, err := strconv.Atoi(mux.Vars(r)["subscriptionId"])
+	if err != nil {
+		http.Error(w, "Invalid subscription id", http.StatusBadRequest)
+		return
+	}
+
+	// Parse the JSON request body
+	var input UpdateSubscriptionInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate fields
+	if input.Title != nil {
+		if title := strings.TrimSpace(*input.Title); title != "" {
+			input.Title = &title
+		} else {
+			input.Title = nil
+		}
+	}
+	if input.DisplayMode == "" {
+		input.DisplayMode = DisplayModeFull
+	}
+	if !slices.Contains(displayModes, input.DisplayMode) {
+		http.Error(w, fmt.Sprintf("Invalid display_mode (must be one of %s)", strings.Join(displayModes, ", ")), http.StatusBadRequest)
+		return
+	}
+	if input.RetentionDays != nil && (*input.RetentionDays < 1 || *input.RetentionDays > maxRetentionDays) {
+		http.Error(w, fmt.Sprintf("Invalid retention_days (must be between 1 and %d)", maxRetentionDays), http.StatusBadRequest)
+		return
+	}
+
+	query := `
+    WITH s AS (
+        UPDATE subscriptions
+        SET title = @title, notify = @notify, display_mode = @display_mode, retention_days = @retention_days
+        WHERE id = @id AND user_id = @user_id
+        RETURNING *
+    )
+    SELECT ` + subscriptionColumns + `
+    FROM s
+    JOIN feeds f ON f.id = s.feed_id
+    `
+	args := pgx.NamedArgs{
+		"id":             subscriptionID,
+		"user_id":        userToken.Id,
+		"title":          input.Title,
+		"notify":         input.Notify,
+		"display_mode":   input.DisplayMode,
+		"retention_days": input.RetentionDays,
+	}
+
+	sub, err := scanSubscription(h.conn.QueryRow(context.Background(), query, args))
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating subscription: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sub)
+}
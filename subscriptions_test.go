@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestHandleUpdateSubscriptionSettings(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	title := "My feed"
+	retention := 90
+	mockPool.ExpectQuery("UPDATE subscriptions").
+		WithArgs(pgx.NamedArgs{
+			"id":             7,
+			"user_id":        "u1",
+			"title":          &title,
+			"notify":         true,
+			"display_mode":   DisplayModeSummary,
+			"retention_days": &retention,
+		}).
+		WillReturnRows(pgxmock.NewRows([]string{
+			"id", "title", "feed_title", "url", "last_checked",
+			"folder_id", "notify", "display_mode", "retention_days", "unread_count",
+		}).AddRow(7, "My feed", "Example", "https://example.com/feed.xml", nil, nil, true, DisplayModeSummary, &retention, 3))
+
+	handler := &Handler{conn: mockPool}
+	body := `{"title":"  My feed ","notify":true,"display_mode":"summary","retention_days":90}`
+	req := httptest.NewRequest(http.MethodPut, "/subscriptions/7", strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"subscriptionId": "7"})
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleUpdateSubscription(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var sub UserSubscription
+	if err := json.NewDecoder(w.Body).Decode(&sub); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if sub.Title != "My feed" || sub.FeedTitle != "Example" || sub.RetentionDays == nil || *sub.RetentionDays != 90 {
+		t.Errorf("Unexpected subscription: %+v", sub)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleUpdateSubscriptionValidation(t *testing.T) {
+	tests := []string{
+		`{"display_mode":"compact"}`,
+		`{"retention_days":0}`,
+		`{"retention_days":100000}`,
+	}
+
+	for _, body := range tests {
+		handler := &Handler{}
+		req := httptest.NewRequest(http.MethodPut, "/subscriptions/7", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"subscriptionId": "7"})
+		req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+		w := httptest.NewRecorder()
+		handler.handleUpdateSubscription(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for %s; got %d", http.StatusBadRequest, body, w.Code)
+		}
+	}
+}
+
+func TestHandleDeleteSubscriptionsRollsBack(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("DELETE FROM subscriptions").
+		WithArgs([]int{1}, "u1").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "feed_id"}).AddRow(1, 5))
+	mockPool.ExpectExec("DELETE FROM items").
+		WithArgs([]int{5}).
+		WillReturnError(errors.New("boom"))
+	mockPool.ExpectRollback()
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodDelete, "/delete-subscriptions", strings.NewReader(`[1]`))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleDeleteSubscriptions(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d; got %d", http.StatusInternalServerError, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// An invalid URL anywhere in the batch is refused before anything is written
+func TestHandleAddSubscriptionsValidatesFirst(t *testing.T) {
+	t.Setenv("UNVERIFIED_MAX_SUBSCRIPTIONS", "-1")
+
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	handler := &Handler{conn: mockPool}
+	body := `[{"title":"Good","href":"https://example.com/feed.xml"},{"title":"Bad","href":"not a url"}]`
+	req := httptest.NewRequest(http.MethodPost, "/add-subscriptions", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleAddSubscriptions(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d; got %d", http.StatusBadRequest, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A failure part way through rolls back the feeds and subscriptions already added
+func TestHandleAddSubscriptionsRollsBack(t *testing.T) {
+	t.Setenv("UNVERIFIED_MAX_SUBSCRIPTIONS", "-1")
+
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("INSERT INTO feeds").
+		WithArgs(pgx.NamedArgs{"url": "https://example.com/feed.xml"}).
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(1))
+	mockPool.ExpectQuery("INSERT INTO feeds").
+		WithArgs(pgx.NamedArgs{"url": "https://example.org/feed.xml"}).
+		WillReturnError(errors.New("connection lost"))
+	mockPool.ExpectRollback()
+
+	handler := &Handler{conn: mockPool}
+	body := `[{"href":"https://example.com/feed.xml"},{"href":"https://example.org/feed.xml"}]`
+	req := httptest.NewRequest(http.MethodPost, "/add-subscriptions", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1"}))
+	w := httptest.NewRecorder()
+	handler.handleAddSubscriptions(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d; got %d", http.StatusInternalServerError, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
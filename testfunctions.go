@@ -23,6 +23,7 @@ func setupTestHandler(t *testing.T) *Handler {
 
 	handler := &Handler{
 		conn: mockPool,
+		keys: newHMACKeySet("test-secret"),
 	}
 
 	return handler
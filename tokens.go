@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type RefreshTokenInput struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Reads the access token lifetime from ACCESS_TOKEN_TTL, falling back to the default
+func getAccessTokenTTL() time.Duration {
+	return getDurationEnv("ACCESS_TOKEN_TTL", defaultAccessTokenTTL)
+}
+
+// Reads the refresh token lifetime from REFRESH_TOKEN_TTL, falling back to the default
+func getRefreshTokenTTL() time.Duration {
+	return getDurationEnv("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL)
+}
+
+// Generates a random token to hand to the client, and the hash to store in its place
+func newOpaqueToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Starts a session for the request's client and issues its access token and
+// first refresh token. The session id is used as the refresh token family.
+func (h *Handler) issueTokens(ctx context.Context, user User, r *http.Request) (TokenResponse, error) {
+	var sessionID string
+	if err := h.conn.QueryRow(
+		ctx,
+		"INSERT INTO sessions (user_id, user_agent, ip) VALUES ($1, $2, $3) RETURNING id",
+		user.Id, r.UserAgent(), clientIP(r),
+	).Scan(&sessionID); err != nil {
+		return TokenResponse{}, fmt.Errorf("error creating session: %w", err)
+	}
+
+	refreshToken, refreshHash, err := newOpaqueToken()
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	query := `
+    INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+    VALUES ($1, $2, $3, $4)
+    `
+	if _, err := h.conn.Exec(ctx, query, user.Id, sessionID, refreshHash, time.Now().Add(getRefreshTokenTTL())); err != nil {
+		return TokenResponse{}, fmt.Errorf("error storing refresh token: %w", err)
+	}
+
+	accessToken, err := h.keys.generateJWT(user, sessionID)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	return TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(getAccessTokenTTL().Seconds()),
+	}, nil
+}
+
+// Exchanges a refresh token for a new token pair in the same family. Presenting
+// a token that has already been used revokes the whole family.
+func (h *Handler) rotateRefreshToken(ctx context.Context, refreshToken string) (TokenResponse, error) {
+	tokenHash := hashToken(refreshToken)
+
+	newToken, newHash, err := newOpaqueToken()
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	// The old token is only used up if its replacement is stored, otherwise the
+	// client's retry would look like reuse
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		return TokenResponse{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Mark the token used, only if it is still valid
+	var user User
+	var familyID string
+	query := `
+    UPDATE refresh_tokens rt
+    SET used_at = now()
+    FROM users u
+    WHERE rt.token_hash = $1
+        AND rt.used_at IS NULL
+        AND rt.revoked_at IS NULL
+        AND rt.expires_at > now()
+        AND u.id = rt.user_id
+        AND u.disabled_at IS NULL
+    RETURNING rt.family_id, u.id, u.username, u.email, u.role
+    `
+	err = tx.QueryRow(ctx, query, tokenHash).Scan(&familyID, &user.Id, &user.Username, &user.Email, &user.Role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		tx.Rollback(ctx)
+		return TokenResponse{}, h.detectRefreshTokenReuse(ctx, tokenHash)
+	}
+	if err != nil {
+		return TokenResponse{}, fmt.Errorf("error using refresh token: %w", err)
+	}
+
+	insertQuery := `
+    INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+    VALUES ($1, $2, $3, $4)
+    `
+	if _, err := tx.Exec(ctx, insertQuery, user.Id, familyID, newHash, time.Now().Add(getRefreshTokenTTL())); err != nil {
+		return TokenResponse{}, fmt.Errorf("error storing refresh token: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return TokenResponse{}, fmt.Errorf("error storing refresh token: %w", err)
+	}
+
+	accessToken, err := h.keys.generateJWT(user, familyID)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	return TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: newToken,
+		ExpiresIn:    int(getAccessTokenTTL().Seconds()),
+	}, nil
+}
+
+// Revokes the session of a refresh token that was already used, since either the
+// client or an attacker holds a stolen copy
+func (h *Handler) detectRefreshTokenReuse(ctx context.Context, tokenHash string) error {
+	var sessionID string
+	err := h.conn.QueryRow(
+		ctx,
+		"SELECT family_id FROM refresh_tokens WHERE token_hash = $1 AND used_at IS NOT NULL",
+		tokenHash,
+	).Scan(&sessionID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return fmt.Errorf("error checking refresh token: %w", err)
+	}
+
+	if err := h.revokeSession(ctx, sessionID); err != nil {
+		return fmt.Errorf("error revoking token family: %w", err)
+	}
+
+	return ErrRefreshTokenReused
+}
+
+// Revokes the session, and so every token in the family, of the given refresh token
+func (h *Handler) revokeRefreshTokenFamily(ctx context.Context, refreshToken string) error {
+	var sessionID string
+	err := h.conn.QueryRow(
+		ctx,
+		"SELECT family_id FROM refresh_tokens WHERE token_hash = $1",
+		hashToken(refreshToken),
+	).Scan(&sessionID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return h.revokeSession(ctx, sessionID)
+}
+
+// Sends a token pair as JSON
+func writeTokenResponse(w http.ResponseWriter, tokens TokenResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (h *Handler) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	// Parse the JSON request body
+	var input RefreshTokenInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if input.RefreshToken == "" {
+		http.Error(w, "Missing required field (refresh_token)", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := h.rotateRefreshToken(context.Background(), input.RefreshToken)
+	if err != nil {
+		if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error refreshing token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeTokenResponse(w, tokens)
+}
+
+func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	// Parse the JSON request body
+	var input RefreshTokenInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if input.RefreshToken == "" {
+		http.Error(w, "Missing required field (refresh_token)", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.revokeRefreshTokenFamily(context.Background(), input.RefreshToken); err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking refresh token: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestRotateRefreshTokenReuseRevokesFamily(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	tokenHash := hashToken("used-token")
+
+	// The token is no longer valid, so marking it used matches nothing
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("UPDATE refresh_tokens rt").
+		WithArgs(tokenHash).
+		WillReturnRows(pgxmock.NewRows([]string{"family_id", "id", "username", "email", "role"}))
+	mockPool.ExpectRollback()
+	mockPool.ExpectQuery("SELECT family_id FROM refresh_tokens").
+		WithArgs(tokenHash).
+		WillReturnRows(pgxmock.NewRows([]string{"family_id"}).AddRow("s1"))
+	mockPool.ExpectBegin()
+	mockPool.ExpectExec("UPDATE sessions SET revoked_at").
+		WithArgs("s1").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mockPool.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+		WithArgs("s1").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+	mockPool.ExpectCommit()
+
+	handler := &Handler{conn: mockPool}
+	if _, err := handler.rotateRefreshToken(context.Background(), "used-token"); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("Expected %v; got %v", ErrRefreshTokenReused, err)
+	}
+
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRotateRefreshTokenUnknown(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	tokenHash := hashToken("unknown-token")
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("UPDATE refresh_tokens rt").
+		WithArgs(tokenHash).
+		WillReturnRows(pgxmock.NewRows([]string{"family_id", "id", "username", "email", "role"}))
+	mockPool.ExpectRollback()
+	mockPool.ExpectQuery("SELECT family_id FROM refresh_tokens").
+		WithArgs(tokenHash).
+		WillReturnRows(pgxmock.NewRows([]string{"family_id"}))
+
+	handler := &Handler{conn: mockPool}
+	if _, err := handler.rotateRefreshToken(context.Background(), "unknown-token"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Expected %v; got %v", ErrInvalidRefreshToken, err)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A token whose replacement can't be stored stays usable, so the client's retry
+// isn't taken for reuse
+func TestRotateRefreshTokenRollsBack(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	tokenHash := hashToken("valid-token")
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("UPDATE refresh_tokens rt").
+		WithArgs(tokenHash).
+		WillReturnRows(pgxmock.NewRows([]string{"family_id", "id", "username", "email", "role"}).AddRow("s1", "u1", "user", "test@email.com", RoleUser))
+	mockPool.ExpectExec("INSERT INTO refresh_tokens").
+		WithArgs("u1", "s1", pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnError(errors.New("connection lost"))
+	mockPool.ExpectRollback()
+
+	handler := &Handler{conn: mockPool, keys: newHMACKeySet("test-secret")}
+	if _, err := handler.rotateRefreshToken(context.Background(), "valid-token"); err == nil {
+		t.Error("Expected an error")
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpPeriod           = 30
+	totpDigits           = 6
+	totpModulus          = 1000000 // 10^totpDigits
+	totpSkew             = 1
+	totpSecretSize       = 20
+	recoveryCodeCount    = 10
+	recoveryCodeBytes    = 10
+	loginChallengeTTL    = 5 * time.Minute
+	maxChallengeAttempts = 5
+	defaultTOTPIssuer    = "Reader"
+)
+
+var (
+	ErrTOTPNotEnrolled     = errors.New("Two-factor authentication is not enabled")
+	ErrTOTPAlreadyEnrolled = errors.New("Two-factor authentication is already enabled")
+	ErrInvalidTOTPCode     = errors.New("Invalid two-factor code")
+	ErrInvalidChallenge    = errors.New("Invalid or expired login challenge")
+)
+
+type TOTPEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type TOTPCodeInput struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// Returned by handleLogin instead of tokens when the user has 2FA enabled
+type LoginChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresIn         int    `json:"expires_in"`
+}
+
+type LoginChallengeInput struct {
+	ChallengeToken string `json:"challenge_token"`
+	TOTPCodeInput
+}
+
+// Generates the HOTP value for a counter (RFC 4226) using SHA-1
+func hotp(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, code%totpModulus)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// Checks a TOTP code against the steps around t and returns the matching step.
+// Steps at or before lastUsedStep are rejected so a code can't be replayed.
+func verifyTOTP(secret string, code string, t time.Time, lastUsedStep int64) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(t)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(key, uint64(step))), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return totpEncoding.DecodeString(strings.ToUpper(secret))
+}
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// Builds the otpauth:// URI that authenticator apps import, usually from a QR code
+func totpURI(secret string, account string) string {
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = defaultTOTPIssuer
+	}
+
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
+
+// Generates recovery codes of 80 random bits, formatted like "abcde-12345-f6789-0abcd"
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := randomHex(recoveryCodeBytes)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:10] + "-" + code[10:15] + "-" + code[15:]
+	}
+	return codes, nil
+}
+
+// Recovery codes are hashed without the dashes, so they can be typed either way
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// Reports whether the user has confirmed 2FA
+func (h *Handler) totpEnabled(ctx context.Context, userID string) (bool, error) {
+	var enabled bool
+	err := h.conn.QueryRow(
+		ctx,
+		"SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)",
+		userID,
+	).Scan(&enabled)
+	return enabled, err
+}
+
+// Checks a TOTP code or, failing that, a recovery code for a user with confirmed
+// 2FA. Either is used up on success.
+func (h *Handler) verifySecondFactor(ctx context.Context, userID string, input TOTPCodeInput) error {
+	if input.Code != "" {
+		var secret string
+		var lastUsedStep int64
+		err := h.conn.QueryRow(
+			ctx,
+			"SELECT secret, last_used_step FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL",
+			userID,
+		).Scan(&secret, &lastUsedStep)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrTOTPNotEnrolled
+		}
+		if err != nil {
+			return fmt.Errorf("error getting TOTP secret: %w", err)
+		}
+
+		step, ok := verifyTOTP(secret, input.Code, time.Now(), lastUsedStep)
+		if !ok {
+			return ErrInvalidTOTPCode
+		}
+
+		// Record the step, unless a concurrent request already used it
+		tag, err := h.conn.Exec(
+			ctx,
+			"UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2",
+			userID, step,
+		)
+		if err != nil {
+			return fmt.Errorf("error recording TOTP use: %w", err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrInvalidTOTPCode
+		}
+		return nil
+	}
+
+	if input.RecoveryCode != "" {
+		return h.useRecoveryCode(ctx, userID, input.RecoveryCode)
+	}
+
+	return ErrInvalidTOTPCode
+}
+
+// Lockout key for codes entered by a signed in user. It has no @, so it can't
+// clash with a login lockout on an email.
+func accountLockoutKey(userID string) string {
+	return "user:" + userID
+}
+
+// Checks a code for a signed in user, with wrong codes counting toward a lockout
+// as they do at login, so a stolen access token can't be used to guess codes.
+// Returns how long the user is locked for if they are.
+func (h *Handler) verifyAccountSecondFactor(ctx context.Context, userID string, input TOTPCodeInput) (time.Duration, error) {
+	key := accountLockoutKey(userID)
+	wait, err := h.loginLockout(ctx, key)
+	if err != nil {
+		return 0, fmt.Errorf("error checking lockout: %w", err)
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	if err := h.verifySecondFactor(ctx, userID, input); err != nil {
+		if errors.Is(err, ErrInvalidTOTPCode) {
+			if err := h.recordLoginFailure(ctx, key); err != nil {
+				log.Printf("Error recording failed code for user %s: %v", userID, err)
+			}
+		}
+		return 0, err
+	}
+
+	if err := h.resetLoginFailures(ctx, key); err != nil {
+		log.Printf("Error resetting failed codes for user %s: %v", userID, err)
+	}
+	return 0, nil
+}
+
+// Checks a recovery code against the user's unused ones and uses it up. Codes
+// are bcrypt hashed, so each has to be compared in turn. The rows are locked so
+// concurrent requests can't both use the same code.
+func (h *Handler) useRecoveryCode(ctx context.Context, userID string, code string) error {
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(
+		ctx,
+		"SELECT id, code_hash FROM totp_recovery_codes WHERE user_id = $1 AND used_at IS NULL FOR UPDATE",
+		userID,
+	)
+	if err != nil {
+		return fmt.Errorf("error getting recovery codes: %w", err)
+	}
+
+	var matchID int64
+	var id int64
+	var codeHash string
+	normalized := []byte(normalizeRecoveryCode(code))
+	if _, err := pgx.ForEachRow(rows, []any{&id, &codeHash}, func() error {
+		if matchID == 0 && bcrypt.CompareHashAndPassword([]byte(codeHash), normalized) == nil {
+			matchID = id
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error getting recovery codes: %w", err)
+	}
+	if matchID == 0 {
+		return ErrInvalidTOTPCode
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE totp_recovery_codes SET used_at = now() WHERE id = $1", matchID); err != nil {
+		return fmt.Errorf("error using recovery code: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("error using recovery code: %w", err)
+	}
+	return nil
+}
+
+// Stores a login challenge for a user who has passed the password check
+func (h *Handler) createLoginChallenge(ctx context.Context, userID string) (LoginChallengeResponse, error) {
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return LoginChallengeResponse{}, err
+	}
+
+	if _, err := h.conn.Exec(
+		ctx,
+		"INSERT INTO login_challenges (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		tokenHash, userID, time.Now().Add(loginChallengeTTL),
+	); err != nil {
+		return LoginChallengeResponse{}, fmt.Errorf("error storing login challenge: %w", err)
+	}
+
+	return LoginChallengeResponse{
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+		ExpiresIn:         int(loginChallengeTTL.Seconds()),
+	}, nil
+}
+
+func (h *Handler) handleLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Parse the JSON request body
+	var input LoginChallengeInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if input.ChallengeToken == "" || (input.Code == "" && input.RecoveryCode == "") {
+		http.Error(w, "Missing required fields (challenge_token, code or recovery_code)", http.StatusBadRequest)
+		return
+	}
+
+	// Count the attempt, only if the challenge is still valid
+	var user User
+	query := `
+    UPDATE login_challenges c
+    SET attempts = c.attempts + 1
+    FROM users u
+    WHERE c.token_hash = $1
+        AND c.expires_at > now()
+        AND c.attempts < $2
+        AND u.id = c.user_id
+        AND u.disabled_at IS NULL
+    RETURNING u.id, u.username, u.email, u.role
+    `
+	err := h.conn.QueryRow(
+		context.Background(), query, hashToken(input.ChallengeToken), maxChallengeAttempts,
+	).Scan(&user.Id, &user.Username, &user.Email, &user.Role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, ErrInvalidChallenge.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking login challenge: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Codes are refused while the email is locked, so they can't be guessed
+	// any faster than passwords
+	wait, err := h.loginLockout(context.Background(), user.Email)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking login lockout: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+
+	if err := h.verifySecondFactor(context.Background(), user.Id, input.TOTPCodeInput); err != nil {
+		if errors.Is(err, ErrInvalidTOTPCode) || errors.Is(err, ErrTOTPNotEnrolled) {
+			// Wrong codes count toward the lockout like wrong passwords
+			if err := h.recordLoginFailure(context.Background(), user.Email); err != nil {
+				log.Printf("Error recording failed login for user %s: %v", user.Id, err)
+			}
+			http.Error(w, ErrInvalidTOTPCode.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error verifying code: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The challenge can't be used again
+	if _, err := h.conn.Exec(
+		context.Background(),
+		"DELETE FROM login_challenges WHERE token_hash = $1",
+		hashToken(input.ChallengeToken),
+	); err != nil {
+		http.Error(w, fmt.Sprintf("Error removing login challenge: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.resetLoginFailures(context.Background(), user.Email); err != nil {
+		log.Printf("Error resetting failed logins for user %s: %v", user.Id, err)
+	}
+
+	// create access and refresh tokens
+	tokens, err := h.issueTokens(context.Background(), user, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeTokenResponse(w, tokens)
+}
+
+func (h *Handler) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, "Error generating secret", http.StatusInternalServerError)
+		return
+	}
+
+	// Replace any unconfirmed secret, but never a confirmed one
+	query := `
+    INSERT INTO user_totp (user_id, secret)
+    VALUES ($1, $2)
+    ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, created_at = now(), last_used_step = 0
+    WHERE user_totp.confirmed_at IS NULL
+    `
+	tag, err := h.conn.Exec(context.Background(), query, userToken.Id, secret)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error storing secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, ErrTOTPAlreadyEnrolled.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TOTPEnrollResponse{
+		Secret:     secret,
+		OTPAuthURI: totpURI(secret, userToken.Email),
+	})
+}
+
+func (h *Handler) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Parse the JSON request body
+	var input TOTPCodeInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if input.Code == "" {
+		http.Error(w, "Missing required field (code)", http.StatusBadRequest)
+		return
+	}
+
+	var secret string
+	err := h.conn.QueryRow(
+		context.Background(),
+		"SELECT secret FROM user_totp WHERE user_id = $1 AND confirmed_at IS NULL",
+		userToken.Id,
+	).Scan(&secret)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "No pending two-factor enrollment", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	step, ok := verifyTOTP(secret, input.Code, time.Now(), 0)
+	if !ok {
+		http.Error(w, ErrInvalidTOTPCode.Error(), http.StatusBadRequest)
+		return
+	}
+
+	codes, codeHashes, err := newHashedRecoveryCodes()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating recovery codes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// 2FA is only turned on together with its recovery codes
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(
+		ctx,
+		"UPDATE user_totp SET confirmed_at = now(), last_used_step = $3 WHERE user_id = $1 AND secret = $2 AND confirmed_at IS NULL",
+		userToken.Id, secret, step,
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error confirming two-factor authentication: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "No pending two-factor enrollment", http.StatusConflict)
+		return
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userToken.Id, codeHashes); err != nil {
+		http.Error(w, fmt.Sprintf("Error storing recovery codes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error confirming two-factor authentication: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Recovery codes are only ever shown in this response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// Generates a new set of recovery codes and their bcrypt hashes, which are
+// slow enough that a leaked table can't be brute forced
+func newHashedRecoveryCodes() ([]string, []string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(normalizeRecoveryCode(code)), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes[i] = string(hash)
+	}
+
+	return codes, hashes, nil
+}
+
+// Replaces the user's recovery codes with the given hashes. Run it in a
+// transaction so a failure can't leave only some of the codes replaced.
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID string, codeHashes []string) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM totp_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	for _, codeHash := range codeHashes {
+		if _, err := tx.Exec(
+			ctx,
+			"INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, codeHash,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *Handler) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Parse the JSON request body
+	var input TOTPCodeInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// A current code is required so a stolen access token can't turn 2FA off
+	wait, err := h.verifyAccountSecondFactor(context.Background(), userToken.Id, input)
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, ErrTOTPNotEnrolled) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrInvalidTOTPCode) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error verifying code: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The secret and recovery codes go together or not at all
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM user_totp WHERE user_id = $1", userToken.Id); err != nil {
+		http.Error(w, fmt.Sprintf("Error disabling two-factor authentication: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM totp_recovery_codes WHERE user_id = $1", userToken.Id); err != nil {
+		http.Error(w, fmt.Sprintf("Error removing recovery codes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error disabling two-factor authentication: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	// Get user token
+	userToken, ok := r.Context().Value(userTokenKey).(*Token)
+	if !ok {
+		http.Error(w, "No claims found in context", http.StatusForbidden)
+		return
+	}
+
+	// Parse the JSON request body
+	var input TOTPCodeInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	wait, err := h.verifyAccountSecondFactor(context.Background(), userToken.Id, TOTPCodeInput{Code: input.Code})
+	if wait > 0 {
+		writeTooManyRequests(w, wait)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, ErrTOTPNotEnrolled) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrInvalidTOTPCode) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error verifying code: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	codes, codeHashes, err := newHashedRecoveryCodes()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error generating recovery codes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := context.Background()
+	tx, err := h.conn.Begin(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if err := replaceRecoveryCodes(ctx, tx, userToken.Id, codeHashes); err != nil {
+		http.Error(w, fmt.Sprintf("Error storing recovery codes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, fmt.Sprintf("Error storing recovery codes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RFC 6238 test vectors for SHA-1, truncated to 6 digits
+func TestVerifyTOTP(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		now := time.Unix(tt.unix, 0)
+		step, ok := verifyTOTP(secret, tt.code, now, 0)
+		if !ok {
+			t.Errorf("Expected code %s to be valid at %d", tt.code, tt.unix)
+			continue
+		}
+		if step != totpStep(now) {
+			t.Errorf("Expected step %d; got %d", totpStep(now), step)
+		}
+
+		// The same code can't be used twice
+		if _, ok := verifyTOTP(secret, tt.code, now, step); ok {
+			t.Errorf("Expected code %s to be rejected after use", tt.code)
+		}
+	}
+
+	if _, ok := verifyTOTP(secret, "000000", time.Unix(59, 0), 0); ok {
+		t.Error("Expected wrong code to be rejected")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	t.Setenv("TOTP_ISSUER", "Reader")
+
+	uri := totpURI("ABC", "test@email.com")
+	if !strings.HasPrefix(uri, "otpauth://totp/Reader:test@email.com?") || !strings.Contains(uri, "secret=ABC") {
+		t.Errorf("Unexpected otpauth URI %s", uri)
+	}
+}
+
+func TestHandleLoginTwoFactorExhaustedChallenge(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	// Expired, used up or unknown challenges match nothing
+	mockPool.ExpectQuery("UPDATE login_challenges c").
+		WithArgs(hashToken("challenge"), maxChallengeAttempts).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "role"}))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader(`{"challenge_token":"challenge","code":"123456"}`))
+	w := httptest.NewRecorder()
+	handler.handleLoginTwoFactor(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d; got %d", http.StatusUnauthorized, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleLoginTwoFactorWrongCodeCountsAsFailure(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("UPDATE login_challenges c").
+		WithArgs(hashToken("challenge"), maxChallengeAttempts).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "role"}).AddRow("u1", "user", "test@email.com", RoleUser))
+	mockPool.ExpectQuery("SELECT locked_until FROM login_failures").
+		WithArgs("test@email.com").
+		WillReturnError(pgx.ErrNoRows)
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("SELECT id, code_hash FROM totp_recovery_codes").
+		WithArgs("u1").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "code_hash"}))
+	mockPool.ExpectRollback()
+	mockPool.ExpectExec("INSERT INTO login_failures").
+		WithArgs("test@email.com", pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader(`{"challenge_token":"challenge","recovery_code":"wrong"}`))
+	w := httptest.NewRecorder()
+	handler.handleLoginTwoFactor(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d; got %d", http.StatusUnauthorized, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleLoginTwoFactorLockedOut(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	mockPool.ExpectQuery("UPDATE login_challenges c").
+		WithArgs(hashToken("challenge"), maxChallengeAttempts).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "role"}).AddRow("u1", "user", "test@email.com", RoleUser))
+	lockedUntil := time.Now().Add(time.Minute)
+	mockPool.ExpectQuery("SELECT locked_until FROM login_failures").
+		WithArgs("test@email.com").
+		WillReturnRows(pgxmock.NewRows([]string{"locked_until"}).AddRow(&lockedUntil))
+
+	// No code is checked while the email is locked
+	handler := &Handler{conn: mockPool}
+	req := httptest.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader(`{"challenge_token":"challenge","recovery_code":"guess"}`))
+	w := httptest.NewRecorder()
+	handler.handleLoginTwoFactor(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d; got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	other, err := bcrypt.GenerateFromPassword([]byte("00000000000000000000"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("abcde12345f67890abcd"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockPool.ExpectBegin()
+	mockPool.ExpectQuery("SELECT id, code_hash FROM totp_recovery_codes").
+		WithArgs("u1").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "code_hash"}).AddRow(int64(1), string(other)).AddRow(int64(2), string(hash)))
+	mockPool.ExpectExec("UPDATE totp_recovery_codes SET used_at").
+		WithArgs(int64(2)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mockPool.ExpectCommit()
+
+	// Case and dashes don't matter
+	handler := &Handler{conn: mockPool}
+	if err := handler.useRecoveryCode(context.Background(), "u1", " ABCDE-12345-F6789-0ABCD "); err != nil {
+		t.Errorf("Expected recovery code to be accepted; got %v", err)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("Expected %d codes; got %d", recoveryCodeCount, len(codes))
+	}
+	for _, code := range codes {
+		if len(normalizeRecoveryCode(code)) != recoveryCodeBytes*2 {
+			t.Errorf("Expected %d bits in %q", recoveryCodeBytes*8, code)
+		}
+	}
+}
+
+func TestHandleDisableTOTPLocksOutAfterWrongCodes(t *testing.T) {
+	mockPool, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockPool.Close()
+
+	key := accountLockoutKey("u1")
+	handler := &Handler{conn: mockPool}
+	disable := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/2fa/disable", strings.NewReader(`{"recovery_code":"guess"}`))
+		req = req.WithContext(context.WithValue(req.Context(), userTokenKey, &Token{Id: "u1", SessionId: "s1"}))
+		w := httptest.NewRecorder()
+		handler.handleDisableTOTP(w, req)
+		return w.Code
+	}
+
+	// Each wrong code is recorded against the user
+	for i := 0; i < loginLockoutThreshold; i++ {
+		mockPool.ExpectQuery("SELECT locked_until FROM login_failures").
+			WithArgs(key).
+			WillReturnError(pgx.ErrNoRows)
+		mockPool.ExpectBegin()
+		mockPool.ExpectQuery("SELECT id, code_hash FROM totp_recovery_codes").
+			WithArgs("u1").
+			WillReturnRows(pgxmock.NewRows([]string{"id", "code_hash"}))
+		mockPool.ExpectRollback()
+		mockPool.ExpectExec("INSERT INTO login_failures").
+			WithArgs(key, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		if code := disable(); code != http.StatusBadRequest {
+			t.Fatalf("Expected status %d; got %d", http.StatusBadRequest, code)
+		}
+	}
+
+	// Once locked, no code is checked
+	lockedUntil := time.Now().Add(time.Minute)
+	mockPool.ExpectQuery("SELECT locked_until FROM login_failures").
+		WithArgs(key).
+		WillReturnRows(pgxmock.NewRows([]string{"locked_until"}).AddRow(&lockedUntil))
+
+	if code := disable(); code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d; got %d", http.StatusTooManyRequests, code)
+	}
+	if err := mockPool.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}